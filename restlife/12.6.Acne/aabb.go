@@ -45,6 +45,13 @@ func NewAABBBox(box0, box1 AABB) AABB {
 }
 
 func (aabb AABB) Hit(r Ray, intvl Interval) bool {
+	ok, _ := aabb.Clip(r, intvl)
+	return ok
+}
+
+func (aabb AABB) Clip(r Ray, intvl Interval) (bool, Interval) {
+	// Returns whether the ray overlaps the box within the interval, and the part of the
+	// interval that lies inside the box.
 	for axis := range 3 {
 		ax := aabb[axis]
 		adinv := 1.0 / r.dir[axis]
@@ -54,7 +61,7 @@ func (aabb AABB) Hit(r Ray, intvl Interval) bool {
 
 		if t0 < t1 {
 			if t0 > intvl.min {
-				intvl.max = t0
+				intvl.min = t0
 			}
 			if t1 < intvl.max {
 				intvl.max = t1
@@ -69,11 +76,11 @@ func (aabb AABB) Hit(r Ray, intvl Interval) bool {
 		}
 
 		if intvl.max <= intvl.min {
-			return false
+			return false, intvl
 		}
 	}
 
-	return true
+	return true, intvl
 }
 
 func (aabb AABB) LongestAxis() int {
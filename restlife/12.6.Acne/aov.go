@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"image/color"
+	"math"
+	"os"
+	"reflect"
+)
+
+// An AOV, or arbitrary output variable, is an extra pass of the image written next to it for
+// compositing and denoising. AOVs are accumulated in the film with the same filter weights
+// as the image, so their edges are antialiased the same way.
+type AOV int
+
+const (
+	AOVAlbedo     AOV = iota // Reflectance of the first surface hit, from its texture
+	AOVNormal                // Shading normal of the first hit, in world space
+	AOVDepth                 // Distance from the camera to the first hit, 0 where the ray escapes
+	AOVPosition              // Position of the first hit, in world space
+	AOVUV                    // Texture coordinates of the first hit
+	AOVObjectID              // Color of the object of the world list hit first
+	AOVMaterialID            // Color of the material hit first
+	AOVDirect                // Light reaching the camera after at most one bounce
+	AOVIndirect              // Light reaching the camera after more bounces, the image being direct plus indirect
+)
+
+func (a AOV) String() string {
+	switch a {
+	case AOVAlbedo:
+		return "albedo"
+	case AOVNormal:
+		return "normal"
+	case AOVDepth:
+		return "depth"
+	case AOVPosition:
+		return "position"
+	case AOVUV:
+		return "uv"
+	case AOVObjectID:
+		return "object"
+	case AOVMaterialID:
+		return "material"
+	case AOVDirect:
+		return "direct"
+	case AOVIndirect:
+		return "indirect"
+	default:
+		return fmt.Sprintf("aov%d", int(a))
+	}
+}
+
+// An AOVRecord is what a camera ray found at its first hit.
+type AOVRecord struct {
+	hit      bool
+	rec      HitRecord
+	distance float64 // Distance from the ray origin to the hit
+	albedo   RGB
+	emitted  RGB // Light emitted at the hit, or the background where the ray escapes
+	direct   RGB
+	indirect RGB
+}
+
+func (a *AOVRecord) Split(emitted, factor, incoming, nextEmitted RGB) {
+	// Splits the light of the ray between the light emitted at the first hit or at the next
+	// one, which is direct, and the rest, which bounced more. The factor weighs the incoming
+	// light scattered at the first hit.
+	a.direct = emitted.Add(factor.Mul(nextEmitted))
+	a.indirect = factor.Mul(incoming.Sub(nextEmitted))
+}
+
+func (c Camera) AOVValues(r Ray, aov AOVRecord, world Hittable) []RGB {
+	// Returns the value of every AOV of the camera for the camera ray.
+	values := make([]RGB, len(c.aovs))
+	for l, a := range c.aovs {
+		switch a {
+		case AOVAlbedo:
+			values[l] = aov.albedo
+		case AOVDirect:
+			values[l] = aov.direct
+		case AOVIndirect:
+			values[l] = aov.indirect
+		}
+		if !aov.hit {
+			continue
+		}
+		switch a {
+		case AOVNormal:
+			values[l] = aov.rec.normal
+		case AOVDepth:
+			values[l] = RGB{aov.distance, aov.distance, aov.distance}
+		case AOVPosition:
+			values[l] = aov.rec.p
+		case AOVUV:
+			values[l] = RGB{aov.rec.u, aov.rec.v, 0}
+		case AOVObjectID:
+			values[l] = IDColor(uint64(TopLevelObject(world, r)))
+		case AOVMaterialID:
+			values[l] = IDColor(MaterialID(aov.rec.mat))
+		}
+	}
+	return values
+}
+
+func TopLevelObject(world Hittable, r Ray) int {
+	// Returns the index of the object of the world list the ray hits first, the objects being
+	// the entries of the list as the scene built them, whatever they contain. Only camera
+	// rays with an object ID pass look for it.
+	list, ok := world.(HittableList)
+	if !ok {
+		return 0
+	}
+	first, closest := 0, math.MaxFloat64
+	for i, object := range list.objects {
+		if hit, rec := object.Hit(r, Interval{0.001, closest}); hit {
+			first, closest = i, rec.t
+		}
+	}
+	return first
+}
+
+func MaterialID(mat Material) uint64 {
+	// Hashes the material from its parameters, the same on every machine. Slices are only
+	// summarized by their length and their first and last elements, so materials with large
+	// textures are quick to tell apart too.
+	h := fnv.New64a()
+	HashSummary(h, reflect.ValueOf(mat), 8)
+	return h.Sum64()
+}
+
+func HashSummary(h hash.Hash64, v reflect.Value, depth int) {
+	if depth <= 0 {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(v.Len()))
+		h.Write(buf[:])
+		if v.Len() > 0 {
+			HashSummary(h, v.Index(0), depth-1)
+			HashSummary(h, v.Index(v.Len()-1), depth-1)
+		}
+	case reflect.Array:
+		for i := range v.Len() {
+			HashSummary(h, v.Index(i), depth)
+		}
+	case reflect.Struct:
+		h.Write([]byte(v.Type().String()))
+		for i := range v.NumField() {
+			HashSummary(h, v.Field(i), depth)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			HashSummary(h, v.Elem(), depth-1)
+		}
+	default:
+		HashValue(h, v, map[uintptr]bool{})
+	}
+}
+
+func IDColor(id uint64) RGB {
+	// Gives every ID a bright color of its own, for ID mattes.
+	bits := MixBits(id)
+	channel := func(shift uint) float64 {
+		return 0.2 + 0.8*float64(bits>>shift&0xff)/255
+	}
+	return RGB{channel(0), channel(8), channel(16)}
+}
+
+func (c *Camera) WriteAOVs(film Film) {
+	// Writes every AOV as floats for compositing, along with the image, and as a PNG to look
+	// at, named after the image and the AOV.
+	pixels := make([]RGB, c.imageWidth*c.imageHeight)
+	for j := range c.imageHeight {
+		for i := range c.imageWidth {
+			pixels[i+j*c.imageWidth] = film.Pixel(i, j)
+		}
+	}
+	WritePfm("3-12.6", pixels, c.imageWidth, c.imageHeight)
+
+	for l, a := range c.aovs {
+		for j := range c.imageHeight {
+			for i := range c.imageWidth {
+				pixels[i+j*c.imageWidth] = film.Layer(l, i, j)
+			}
+		}
+		name := "3-12.6-" + a.String()
+		WritePfm(name, pixels, c.imageWidth, c.imageHeight)
+		WritePng(name, AOVPreview(a, pixels), c.imageWidth, c.imageHeight)
+	}
+}
+
+func AOVPreview(a AOV, pixels []RGB) []color.Color {
+	// Maps the values of the AOV to colors: light and reflectance through the gamma of the
+	// image, normals from [-1, 1], and depths and positions from their range over the image.
+	preview := make([]color.Color, len(pixels))
+	low, high := RGB{math.Inf(1), math.Inf(1), math.Inf(1)}, RGB{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range pixels {
+		for k := range p {
+			if a == AOVDepth && p[k] == 0 {
+				continue
+			}
+			low[k], high[k] = math.Min(low[k], p[k]), math.Max(high[k], p[k])
+		}
+	}
+	if a == AOVDepth {
+		low = RGB{0, 0, 0}
+	}
+
+	for n, p := range pixels {
+		switch a {
+		case AOVNormal:
+			p = p.Add(RGB{1, 1, 1}).Muln(0.5)
+		case AOVDepth, AOVPosition:
+			for k := range p {
+				if high[k] > low[k] {
+					p[k] = (p[k] - low[k]) / (high[k] - low[k])
+				}
+			}
+		case AOVUV:
+		default:
+			preview[n] = p.Color()
+			continue
+		}
+		preview[n] = color.RGBA{uint8(255 * Clamp(p[0], 0, 1)), uint8(255 * Clamp(p[1], 0, 1)), uint8(255 * Clamp(p[2], 0, 1)), 0xff}
+	}
+	return preview
+}
+
+func WritePfm(name string, pixels []RGB, imageWidth, imageHeight int) {
+	// Writes the pixels as a Portable Float Map, little endian, rows going from the bottom of
+	// the image to its top.
+	f, err := os.Create(name + ".pfm.tmp")
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "PF\n%d %d\n-1.0\n", imageWidth, imageHeight)
+	for j := imageHeight - 1; j >= 0; j-- {
+		for i := range imageWidth {
+			for _, v := range pixels[i+j*imageWidth] {
+				binary.Write(w, binary.LittleEndian, float32(v))
+			}
+		}
+	}
+	w.Flush()
+	f.Close()
+	os.Rename(name+".pfm.tmp", name+".pfm")
+}
@@ -1,40 +1,59 @@
 package main
 
 import (
+	"errors"
 	"image"
 	"image/color"
 	"image/png"
+	"io/fs"
 	"log"
 	"math"
-	"math/rand/v2"
 	"os"
+	"os/signal"
+	"time"
 )
 
 type Camera struct {
-	aspectRadio       float64 // Ratio of image width over height
-	imageWidth        int     // Rendered image width in pixel count
-	samplesPerPixel   int     // Count of random samples for each pixel
-	maxDepth          int     // Maximum number of ray bounces into scene
-	background        RGB     // Scene background color
-	vfov              float64 // Vertical view angle (field of view)
-	lookfrom          Point3  // Point camera is looking from
-	lookat            Point3  // Point camera is looking at
-	vup               Vec3    // Camera-relative "up" direction
-	defocusAngle      float64 // Variation angle of rays through each pixel
-	focusDist         float64 // Distance from camera lookfrom point to plane of perfect focus
-	imageHeight       int     // Rendered image height
-	pixelSamplesScale float64 // Color scale factor for a sum of pixel samples
-	sqrtSpp           int     // Square root of number of samples per pixel
-	recipSqrtSpp      float64 // 1 / sqrt_spp
-	center            Point3  // Camera center
-	pixel00Loc        Point3  // Location of pixel 0, 0
-	pixelDeltaU       Vec3    // Offset to pixel to the right
-	pixelDeltaV       Vec3    // Offset to pixel below
-	u, v, w           Vec3    // Camera frame basis vectors
-	defocusDiskU      Vec3    // Defocus disk horizontal radius
-	defocusDiskV      Vec3    // Defocus disk vertical radius
+	aspectRadio       float64       // Ratio of image width over height
+	imageWidth        int           // Rendered image width in pixel count
+	samplesPerPixel   int           // Count of random samples for each pixel
+	maxDepth          int           // Maximum number of ray bounces into scene
+	background        RGB           // Scene background color
+	vfov              float64       // Vertical view angle (field of view)
+	lookfrom          Point3        // Point camera is looking from
+	lookat            Point3        // Point camera is looking at
+	vup               Vec3          // Camera-relative "up" direction
+	defocusAngle      float64       // Variation angle of rays through each pixel
+	focusDist         float64       // Distance from camera lookfrom point to plane of perfect focus
+	imageHeight       int           // Rendered image height
+	center            Point3        // Camera center
+	pixel00Loc        Point3        // Location of pixel 0, 0
+	pixelDeltaU       Vec3          // Offset to pixel to the right
+	pixelDeltaV       Vec3          // Offset to pixel below
+	u, v, w           Vec3          // Camera frame basis vectors
+	defocusDiskU      Vec3          // Defocus disk horizontal radius
+	defocusDiskV      Vec3          // Defocus disk vertical radius
+	spreadAngle       float64       // Angle subtended by one pixel, used for texture filtering
+	projection        Projection    // Maps the film to rays, perspective when nil
+	stereo            StereoLayout  // Renders a pair of views for the two eyes
+	eyeSeparation     float64       // Distance between the eyes of a stereo pair
+	filmWidth         int           // Width of the view of one eye, in pixels
+	filmHeight        int           // Height of the view of one eye, in pixels
+	filter            PixelFilter   // Reconstruction filter of the pixels, a box over each pixel when nil
+	sampler           Sampler       // Provides the sample values of the pixels, stratified when nil
+	adaptiveThreshold float64       // Estimated pixel error below which sampling stops, every pixel getting samplesPerPixel when 0
+	timeBudget        time.Duration // Time after which no more passes are started, no limit when 0
+	snapshotInterval  time.Duration // Time between writes of the image so far, none when 0
+	checkpointFile    string        // Render state saved with the images and resumed from, none when empty
+	sceneHash         uint64        // Hash of the scene and camera, that checkpoints must match
+	aovs              []AOV         // Extra passes written next to the image, none when empty
 }
 
+const (
+	AdaptivePassSamples = 16 // Samples added to every pixel still sampled in a pass
+	AdaptiveMinSamples  = 64 // Samples of a pixel before its error estimate is trusted
+)
+
 func DefaultCamera() Camera {
 	return Camera{
 		aspectRadio:     1.0,
@@ -54,80 +73,266 @@ func (c *Camera) Initialize() {
 	// Calculate the image height, and ensure that it's at least 1.
 	c.imageHeight = max(int(float64(c.imageWidth)/c.aspectRadio), 1)
 
-	c.sqrtSpp = int(math.Sqrt(float64(c.samplesPerPixel)))
-	c.pixelSamplesScale = 1.0 / float64(c.sqrtSpp*c.sqrtSpp)
-	c.recipSqrtSpp = 1.0 / float64(c.sqrtSpp)
-
-	c.pixelSamplesScale = 1.0 / float64(c.samplesPerPixel)
+	if c.filter == nil {
+		c.filter = BoxFilter{0.5}
+	}
+	if c.sampler == nil {
+		c.sampler = &StratifiedSampler{}
+	}
 
 	c.center = c.lookfrom
 
-	// Determine viewport dimensions.
-	theta := Radians(c.vfov)
-	h := math.Tan(theta / 2)
-	viewportHeight := 2 * h * c.focusDist
-	viewportWidth := viewportHeight * (float64(c.imageWidth) / float64(c.imageHeight))
+	// Stereo pairs split the image between the eyes.
+	c.filmWidth, c.filmHeight = c.imageWidth, c.imageHeight
+	switch c.stereo {
+	case StereoSideBySide:
+		c.filmWidth = max(c.imageWidth/2, 1)
+	case StereoOverUnder:
+		c.filmHeight = max(c.imageHeight/2, 1)
+	}
 
 	// Calculate the u,v,w unit basis vectors for the camera coordinate frame.
 	c.w = c.lookfrom.Sub(c.lookat).Normalize()
 	c.u = c.vup.Cross(c.w).Normalize()
 	c.v = c.w.Cross(c.u)
 
-	// Calculate the vectors across the horizontal and down the vertical viewport edges.
-	viewportU := c.u.Muln(viewportWidth)   // Vector across viewport horizontal edge
-	viewportV := c.v.Muln(-viewportHeight) // Vector down viewport vertical edge
+	if c.projection == nil {
+		c.projection = PerspectiveProjection{}
+	}
+	c.projection.Initialize(c)
+}
 
-	// Calculate the horizontal and vertical delta vectors from pixel to pixel.
-	c.pixelDeltaU = viewportU.Divn(float64(c.imageWidth))
-	c.pixelDeltaV = viewportV.Divn(float64(c.imageHeight))
+func (c *Camera) Render(world Hittable, lights Hittable) {
+	c.Initialize()
 
-	// Calculate the location of the upper left pixel.
-	viewportUpperLeft := c.center.Sub(c.w.Muln(c.focusDist)).Sub(viewportU.Divn(2)).Sub(viewportV.Divn(2))
-	c.pixel00Loc = viewportUpperLeft.Add(c.pixelDeltaU.Add(c.pixelDeltaV).Muln(0.5))
+	// Workers render the units their coordinator hands out, which writes the images.
+	if CoordinatorURL != "" {
+		c.Work(world, lights)
+		return
+	}
 
-	// Calculate the camera defocus disk basis vectors.
-	defocusRadius := c.focusDist * math.Tan(Radians(c.defocusAngle/2))
-	c.defocusDiskU = c.u.Muln(defocusRadius)
-	c.defocusDiskV = c.v.Muln(defocusRadius)
+	// Samples are splatted into the film, which normalizes them by their filter weights.
+	// Samples the projection doesn't cover count as black.
+	film := NewFilm(c.imageWidth, c.imageHeight, c.filter, c.aovs)
+	counts := make([]int, c.imageWidth*c.imageHeight)
+
+	// Resume from the checkpoint of an earlier render of the same scene, if there is one.
+	// Coordinators send the hash to their workers too.
+	if c.checkpointFile != "" || CoordinatorAddress != "" {
+		c.sceneHash = SceneHash(world, lights, *c)
+	}
+	if c.checkpointFile != "" {
+		err := LoadCheckpoint(c.checkpointFile, c.sceneHash, &film, counts)
+		switch {
+		case err == nil:
+			log.Printf("Resuming from %s", c.checkpointFile)
+		case !errors.Is(err, fs.ErrNotExist):
+			log.Fatal(err)
+		}
+	}
+
+	var finished bool
+	if CoordinatorAddress != "" {
+		finished = c.Coordinate(&film, counts)
+	} else {
+		finished = c.RenderPasses(&film, counts, world, lights)
+	}
+	if finished {
+		log.Println("Done.")
+	} else {
+		log.Println("Interrupted, saving the image so far.")
+	}
+
+	c.Save(film, counts)
 }
 
-func (c *Camera) Render(world Hittable, lights Hittable) {
-	c.Initialize()
+func (c *Camera) Progressive() bool {
+	// Reports whether the render runs in passes of a few samples over the whole image,
+	// rather than a single pass of all the samples.
+	return c.adaptiveThreshold > 0 || c.timeBudget > 0 || c.snapshotInterval > 0
+}
+
+func (c *Camera) RenderPasses(film *Film, counts []int, world Hittable, lights Hittable) bool {
+	// Renders samplesPerPixel samples in every pixel in a single pass, or progressively in
+	// passes adding a few samples to the pixels whose estimated error is still above the
+	// threshold, until none is left or the time is up. The number of samples of every pixel
+	// is kept in counts. Returns false if the render was interrupted by Ctrl-C.
+	passSamples := c.samplesPerPixel
+	if c.Progressive() {
+		passSamples = AdaptivePassSamples
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	start := time.Now()
+	lastSnapshot := start
+	for pass := 1; ; pass++ {
+		active := 0
+		for j := range c.imageHeight {
+			log.Printf("\rPass %d, scanlines remaining: %d", pass, c.imageHeight-j)
+			for i := range c.imageWidth {
+				k := i + j*c.imageWidth
+				if counts[k] >= c.samplesPerPixel {
+					continue
+				}
+				if c.adaptiveThreshold > 0 && counts[k] >= AdaptiveMinSamples && film.Error(i, j) < c.adaptiveThreshold {
+					continue
+				}
+
+				n := min(passSamples, c.samplesPerPixel-counts[k])
+				for index := counts[k]; index < counts[k]+n; index++ {
+					c.SamplePixel(film, i, j, index, world, lights)
+				}
+				counts[k] += n
+				active++
+			}
+
+			// Scanlines are short enough to check for Ctrl-C and snapshots in between.
+			select {
+			case <-interrupt:
+				return false
+			default:
+			}
+			if c.snapshotInterval > 0 && time.Since(lastSnapshot) >= c.snapshotInterval {
+				log.Printf("Writing a snapshot after %v", time.Since(start).Round(time.Second))
+				c.Save(*film, counts)
+				lastSnapshot = time.Now()
+			}
+		}
+		log.Printf("Pass %d sampled %d pixels", pass, active)
+
+		if active == 0 || c.timeBudget > 0 && time.Since(start) >= c.timeBudget {
+			return true
+		}
+	}
+}
+
+func (c *Camera) Save(film Film, counts []int) {
+	// Writes the images, and the checkpoint if the render keeps one.
+	c.WriteImages(film, counts)
+	if c.checkpointFile != "" {
+		if err := SaveCheckpoint(c.checkpointFile, c.sceneHash, film, counts); err != nil {
+			log.Printf("Can't save the checkpoint: %v", err)
+		}
+	}
+}
 
+func (c *Camera) WriteImages(film Film, counts []int) {
+	// Writes the image, its AOVs, the denoised image if asked for, and with adaptive sampling
+	// or a time budget the number of samples of every pixel next to it.
 	framebuffer := make([]color.Color, c.imageWidth*c.imageHeight)
 	for j := range c.imageHeight {
-		log.Printf("\rScanlines remaining: %d", c.imageHeight-j)
 		for i := range c.imageWidth {
-			pixelColor := RGB{0, 0, 0}
-			for sj := range c.sqrtSpp {
-				for si := range c.sqrtSpp {
-					r := c.GetRay(i, j, si, sj)
-					pixelColor = pixelColor.Add(c.RayColor(r, c.maxDepth, world, lights))
-				}
-			}
-			framebuffer[i+j*c.imageWidth] = pixelColor.Muln(c.pixelSamplesScale).Color()
+			framebuffer[i+j*c.imageWidth] = film.Pixel(i, j).Color()
 		}
 	}
-	log.Println("Done.")
 
 	WritePng("3-12.6", framebuffer, c.imageWidth, c.imageHeight)
+
+	if c.adaptiveThreshold > 0 || c.timeBudget > 0 {
+		WritePng("3-12.6-spp", SamplesImage(counts, c.samplesPerPixel), c.imageWidth, c.imageHeight)
+	}
+
+	if len(c.aovs) > 0 {
+		c.WriteAOVs(film)
+	}
+	if DenoiseImage {
+		c.WriteDenoised(film)
+	}
+}
+
+func (c *Camera) SamplePixel(film *Film, i, j, index int, world Hittable, lights Hittable) {
+	c.sampler.StartPixelSample(i, j, index, c.samplesPerPixel)
+	offsetX, offsetY := c.sampler.Get2D()
+	x := float64(i) + offsetX
+	y := float64(j) + offsetY
+	sampleColor := RGB{0, 0, 0}
+	var values []RGB
+	if r, ok := c.GetRay(x, y); ok {
+		if len(c.aovs) > 0 {
+			var aov AOVRecord
+			sampleColor = c.RayColor(r, c.maxDepth, world, lights, &aov)
+			values = c.AOVValues(r, aov, world)
+		} else {
+			sampleColor = c.RayColor(r, c.maxDepth, world, lights, nil)
+		}
+	} else if len(c.aovs) > 0 {
+		values = make([]RGB, len(c.aovs))
+	}
+	film.AddSample(x, y, sampleColor, values, c.EyeRegion(i, j))
 }
 
-func (c *Camera) GetRay(i, j, si, sj int) Ray {
-	// Construct a Camera ray Originating from the Origin and Directed at randomly sampled point around the pixel location i, j.
-	offset := c.SampleSquareStratified(si, sj)
-	pixelSample := c.pixel00Loc.Add(c.pixelDeltaU.Muln(float64(i) + offset.X())).Add(c.pixelDeltaV.Muln(float64(j) + offset.Y()))
+func (c *Camera) EyeRegion(i, j int) [4]int {
+	// Returns the pixels of the view pixel (i, j) belongs to, as x0, y0, x1, y1 with x1 and
+	// y1 excluded: the whole image, or the half of it seen by one eye of a stereo pair.
+	switch c.stereo {
+	case StereoSideBySide:
+		if i >= c.filmWidth {
+			return [4]int{c.filmWidth, 0, c.imageWidth, c.imageHeight}
+		}
+		return [4]int{0, 0, c.filmWidth, c.imageHeight}
+	case StereoOverUnder:
+		if j >= c.filmHeight {
+			return [4]int{0, c.filmHeight, c.imageWidth, c.imageHeight}
+		}
+		return [4]int{0, 0, c.imageWidth, c.filmHeight}
+	}
+	return [4]int{0, 0, c.imageWidth, c.imageHeight}
+}
+
+func SamplesImage(counts []int, maxCount int) []color.Color {
+	// Shows the number of samples of every pixel, from black for none through blue, red and
+	// yellow to white for maxCount.
+	pixels := make([]color.Color, len(counts))
+	stops := []RGB{{0, 0, 0}, {0, 0, 1}, {1, 0, 0}, {1, 1, 0}, {1, 1, 1}}
+	for k, count := range counts {
+		t := Clamp(float64(count)/float64(maxCount), 0, 1) * float64(len(stops)-1)
+		stop := min(int(t), len(stops)-2)
+		c := Lerp(stops[stop], stops[stop+1], t-float64(stop))
+		pixels[k] = color.RGBA{uint8(255 * c[0]), uint8(255 * c[1]), uint8(255 * c[2]), 0xff}
+	}
+	return pixels
+}
+
+func (c *Camera) GetRay(x, y float64) (Ray, bool) {
+	// Construct a Camera ray through the image point x, y, in pixels from the upper left
+	// corner, or return false for points the projection doesn't cover. The lens and time
+	// samples come next from the sampler, after the film position.
+	lensU, lensV := c.sampler.Get2D()
+	tm := c.sampler.Get1D()
+
+	// Find the eye seeing this pixel, -1 for the left one and 1 for the right one.
+	eye := 0.0
+	switch c.stereo {
+	case StereoSideBySide:
+		eye = -1
+		if x >= float64(c.filmWidth) {
+			x -= float64(c.filmWidth)
+			eye = 1
+		}
+	case StereoOverUnder:
+		eye = -1
+		if y >= float64(c.filmHeight) {
+			y -= float64(c.filmHeight)
+			eye = 1
+		}
+	}
 
-	orig := c.DefocusDiskSample()
-	if c.defocusAngle <= 0 {
-		orig = c.center
+	orig, dir, ok := c.projection.Ray(c, x, y, lensU, lensV)
+	if !ok {
+		return Ray{}, false
+	}
+	if eye != 0 {
+		orig = orig.Add(c.projection.EyeOffset(c, dir).Muln(eye * c.eyeSeparation / 2))
 	}
-	dir := pixelSample.Sub(orig)
-	tm := rand.Float64()
-	return Ray{orig, dir, tm}
+
+	return Ray{orig, dir, tm}, true
 }
 
-func (c Camera) RayColor(r Ray, depth int, world Hittable, lights Hittable) RGB {
+func (c Camera) RayColor(r Ray, depth int, world Hittable, lights Hittable, aov *AOVRecord) RGB {
+	// Camera rays pass an AOV record when the camera has AOVs, filled in at their first hit.
 	// If we've exceeded the ray bounce limit, no more light is gathered.
 	if depth <= 0 {
 		return RGB{0, 0, 0}
@@ -136,56 +341,79 @@ func (c Camera) RayColor(r Ray, depth int, world Hittable, lights Hittable) RGB
 	// If the ray hits nothing, return the background color.
 	hitAnything, rec := world.Hit(r, Interval{0.001, math.MaxFloat64})
 	if !hitAnything {
+		if aov != nil {
+			aov.albedo, aov.emitted, aov.direct = c.background, c.background, c.background
+		}
 		return c.background
 	}
 
+	rec.tm = r.tm
+
+	// Primary rays carry a cone one pixel wide, so textures can filter over its footprint.
+	// The widening of the cone after scattering isn't tracked.
+	if depth == c.maxDepth {
+		cosine := math.Max(math.Abs(r.dir.Normalize().Dot(rec.normal)), 0.05)
+		rec.footprint = c.spreadAngle * rec.t * r.dir.Length() / cosine
+	}
+
 	colorFromEmission := rec.mat.Emitted(r, rec, rec.u, rec.v, rec.p)
-	ok, srec := rec.mat.Scatter(r, rec)
+	if aov != nil {
+		aov.hit, aov.rec, aov.distance, aov.emitted = true, rec, rec.t*r.dir.Length(), colorFromEmission
+	}
+	ok, srec := rec.mat.Scatter(r, rec, c.sampler)
 	if !ok {
+		if aov != nil {
+			// Lights have their color as albedo, scaled down to a reflectance.
+			aov.albedo = colorFromEmission.Divn(math.Max(1, max(colorFromEmission[0], colorFromEmission[1], colorFromEmission[2])))
+			aov.direct = colorFromEmission
+		}
 		return colorFromEmission
 	}
 
+	// The camera ray's first hit tells light emitted at the next hit apart, which is direct.
+	var next *AOVRecord
+	if aov != nil {
+		aov.albedo = srec.attenuation
+		if depth == c.maxDepth {
+			next = &AOVRecord{}
+		}
+	}
+
 	if srec.skipPdf {
-		return srec.attenuation.Mul(c.RayColor(srec.skipPdfRay, depth-1, world, lights))
+		sampleColor := c.RayColor(srec.skipPdfRay, depth-1, world, lights, next)
+		if next != nil {
+			aov.Split(colorFromEmission, srec.attenuation, sampleColor, next.emitted)
+		}
+		return srec.attenuation.Mul(sampleColor)
 	}
 
 	light := HittablePDF{lights, rec.p}
 	p := MixturePDF{light, srec.pdf}
 
-	scattered := Ray{rec.p, p.Generate(), r.tm}
+	scattered := Ray{rec.p, p.Generate(c.sampler), r.tm}
 	pdfValue := p.Value(scattered.dir)
 
 	scatteringPdf := rec.mat.ScatteringPdf(r, rec, scattered)
 
-	sampleColor := c.RayColor(scattered, depth-1, world, lights)
+	sampleColor := c.RayColor(scattered, depth-1, world, lights, next)
 	colorFromScatter := srec.attenuation.Muln(scatteringPdf).Mul(sampleColor).Divn(pdfValue)
+	if next != nil {
+		aov.Split(colorFromEmission, srec.attenuation.Muln(scatteringPdf).Divn(pdfValue), sampleColor, next.emitted)
+	}
 
 	return colorFromEmission.Add(colorFromScatter)
 }
 
-func (c Camera) DefocusDiskSample() Point3 {
-	// Returns a random point in the camera defocus disk.
-	p := RandomInUnitDisk()
+func (c Camera) DefocusDiskSample(r1, r2 float64) Point3 {
+	// Maps a 2D sample to a point in the camera defocus disk.
+	p := SampleUnitDisk(r1, r2)
 	return c.center.Add(c.defocusDiskU.Muln(p[0])).Add(c.defocusDiskV.Muln(p[1]))
 }
 
-func (c Camera) SampleSquareStratified(si, sj int) Vec3 {
-	// Returns the vector to a random point in the square sub-pixel specified by grid
-	// indices s_i and s_j, for an idealized unit square pixel [-.5,-.5] to [+.5,+.5].
-
-	px := (float64(si)+rand.Float64())*c.recipSqrtSpp - 0.5
-	py := (float64(sj)+rand.Float64())*c.recipSqrtSpp - 0.5
-
-	return Vec3{px, py, 0}
-}
-
-func SampleSquare() Vec3 {
-	// Returns the vector to a random point in the [-.5,-.5]-[+.5,+.5] unit square.
-	return Vec3{rand.Float64() - 0.5, rand.Float64() - 0.5, 0}
-}
-
 func WritePng(name string, pixels []color.Color, imageWidth, imageHeight int) {
-	f, _ := os.Create(name + ".png")
+	// The image is written next to its final name and renamed over it, so snapshots never
+	// leave a half written file behind.
+	f, _ := os.Create(name + ".png.tmp")
 	img := image.NewRGBA(image.Rect(0, 0, imageWidth, imageHeight))
 	for j := range imageHeight {
 		for i := range imageWidth {
@@ -194,4 +422,6 @@ func WritePng(name string, pixels []color.Color, imageWidth, imageHeight int) {
 	}
 
 	png.Encode(f, img)
+	f.Close()
+	os.Rename(name+".png.tmp", name+".png")
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+// A Checkpoint is the state of a render saved to disk: the film accumulated so far and the
+// number of samples of every pixel. The stratified, Halton, Sobol and blue noise samplers give
+// the same values for the same pixel and sample index, so the sample counts are all of their
+// state, and a resumed render carries on with the next samples. The independent sampler, and
+// the media, subsurface scattering, alpha masks and curves drawing from the global random
+// numbers, don't: renders using them resume with different but equally distributed samples,
+// the same image statistically but not bit for bit. The hash of the scene and camera makes
+// sure it resumes the same render.
+type Checkpoint struct {
+	SceneHash uint64
+	Width     int
+	Height    int
+	Sum       []RGB
+	Weight    []float64
+	Count     []int
+	Mean      []float64
+	M2        []float64
+	Layers    [][]RGB
+	Samples   []int
+}
+
+func SaveCheckpoint(filename string, hash uint64, film Film, counts []int) error {
+	// Written next to its final name and renamed over it, so an interruption never leaves a
+	// broken checkpoint behind.
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	checkpoint := Checkpoint{hash, film.width, film.height, film.sum, film.weight, film.count, film.mean, film.m2, film.layers, counts}
+	if err := gob.NewEncoder(f).Encode(checkpoint); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func LoadCheckpoint(filename string, hash uint64, film *Film, counts []int) error {
+	// Restores the film and sample counts from the checkpoint, refusing checkpoints of other
+	// scenes or cameras.
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var checkpoint Checkpoint
+	if err := gob.NewDecoder(f).Decode(&checkpoint); err != nil {
+		return err
+	}
+	if checkpoint.SceneHash != hash {
+		return fmt.Errorf("checkpoint %s is of a different scene or camera (hash %016x, expected %016x)", filename, checkpoint.SceneHash, hash)
+	}
+	n := film.width * film.height
+	if checkpoint.Width != film.width || checkpoint.Height != film.height {
+		return fmt.Errorf("checkpoint %s is %dx%d, expected %dx%d", filename, checkpoint.Width, checkpoint.Height, film.width, film.height)
+	}
+	if len(checkpoint.Sum) != n || len(checkpoint.Weight) != n || len(checkpoint.Count) != n || len(checkpoint.Mean) != n || len(checkpoint.M2) != n || len(checkpoint.Samples) != n {
+		// Copying short slices would leave the rest of the film empty.
+		return fmt.Errorf("checkpoint %s has a broken film", filename)
+	}
+	if len(checkpoint.Layers) != len(film.layers) {
+		return fmt.Errorf("checkpoint %s has %d AOVs, expected %d", filename, len(checkpoint.Layers), len(film.layers))
+	}
+	if slices.ContainsFunc(checkpoint.Layers, func(layer []RGB) bool { return len(layer) != n }) {
+		return fmt.Errorf("checkpoint %s has broken AOVs", filename)
+	}
+
+	copy(film.sum, checkpoint.Sum)
+	copy(film.weight, checkpoint.Weight)
+	copy(film.count, checkpoint.Count)
+	copy(film.mean, checkpoint.Mean)
+	copy(film.m2, checkpoint.M2)
+	for l, layer := range checkpoint.Layers {
+		copy(film.layers[l], layer)
+	}
+	copy(counts, checkpoint.Samples)
+	return nil
+}
+
+func SceneHash(world, lights Hittable, c Camera) uint64 {
+	// Hashes everything the image depends on. The settings that only say how long to render
+	// are left out, so a render can be resumed with more samples or time.
+	c.samplesPerPixel = 0
+	c.adaptiveThreshold = 0
+	c.timeBudget = 0
+	c.snapshotInterval = 0
+	c.checkpointFile = ""
+
+	h := fnv.New64a()
+	visited := map[uintptr]bool{}
+	HashValue(h, reflect.ValueOf(world), visited)
+	HashValue(h, reflect.ValueOf(lights), visited)
+	HashValue(h, reflect.ValueOf(c), visited)
+	return h.Sum64()
+}
+
+func HashValue(h hash.Hash64, v reflect.Value, visited map[uintptr]bool) {
+	// Feeds the value to the hash, following pointers, interfaces and slices. Shared objects
+	// are hashed once, and functions by name, since the variables their closures capture
+	// can't be reached.
+	var buf [8]byte
+	writeUint := func(x uint64) {
+		binary.LittleEndian.PutUint64(buf[:], x)
+		h.Write(buf[:])
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		writeUint(0)
+	case reflect.Bool:
+		if v.Bool() {
+			writeUint(1)
+		} else {
+			writeUint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		writeUint(math.Float64bits(real(v.Complex())))
+		writeUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		writeUint(uint64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Array:
+		for i := range v.Len() {
+			HashValue(h, v.Index(i), visited)
+		}
+	case reflect.Slice:
+		writeUint(uint64(v.Len()))
+		if v.Len() > 0 && PlainType(v.Type().Elem()) {
+			// Large rasters and height arrays are hashed as raw memory.
+			size := v.Len() * int(v.Type().Elem().Size())
+			h.Write(unsafe.Slice((*byte)(v.UnsafePointer()), size))
+			return
+		}
+		for i := range v.Len() {
+			HashValue(h, v.Index(i), visited)
+		}
+	case reflect.Struct:
+		h.Write([]byte(v.Type().String()))
+		for i := range v.NumField() {
+			HashValue(h, v.Field(i), visited)
+		}
+	case reflect.Pointer:
+		if v.IsNil() {
+			writeUint(0)
+			return
+		}
+		writeUint(1)
+		if visited[v.Pointer()] {
+			return
+		}
+		visited[v.Pointer()] = true
+		HashValue(h, v.Elem(), visited)
+	case reflect.Interface:
+		if v.IsNil() {
+			writeUint(0)
+			return
+		}
+		HashValue(h, v.Elem(), visited)
+	case reflect.Map:
+		writeUint(uint64(v.Len()))
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+		})
+		for _, key := range keys {
+			HashValue(h, key, visited)
+			HashValue(h, v.MapIndex(key), visited)
+		}
+	case reflect.Func:
+		if v.IsNil() {
+			writeUint(0)
+			return
+		}
+		h.Write([]byte(runtime.FuncForPC(v.Pointer()).Name()))
+	}
+}
+
+func PlainType(t reflect.Type) bool {
+	// Reports whether values of the type are plain numbers, or arrays of them, whose memory
+	// holds nothing but their value.
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Array:
+		return PlainType(t.Elem())
+	default:
+		return false
+	}
+}
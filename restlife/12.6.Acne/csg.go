@@ -0,0 +1,107 @@
+package main
+
+import "math"
+
+type CSGOp int
+
+const (
+	CSGUnion        CSGOp = iota // Inside either object
+	CSGIntersection              // Inside both objects
+	CSGDifference                // Inside the first object but not the second
+)
+
+type CSG struct {
+	op   CSGOp
+	a, b Hittable
+	bbox AABB
+}
+
+func NewCSG(op CSGOp, a, b Hittable) CSG {
+	// Combines two closed objects into one solid. Each object must be watertight, so that the
+	// front faces along a ray mark where it is entered and the back faces where it is left.
+	bbox := NewAABBBox(a.BoundingBox(), b.BoundingBox())
+	switch op {
+	case CSGIntersection:
+		boxA, boxB := a.BoundingBox(), b.BoundingBox()
+		for axis := range 3 {
+			bbox[axis] = Interval{math.Max(boxA[axis].min, boxB[axis].min), math.Min(boxA[axis].max, boxB[axis].max)}
+		}
+	case CSGDifference:
+		bbox = a.BoundingBox()
+	}
+	return CSG{op, a, b, bbox}
+}
+
+func (hit CSG) Inside(inA, inB bool) bool {
+	switch hit.op {
+	case CSGIntersection:
+		return inA && inB
+	case CSGDifference:
+		return inA && !inB
+	default:
+		return inA || inB
+	}
+}
+
+func (hit CSG) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	if !hit.bbox.Hit(r, intvl) {
+		return false, HitRecord{}
+	}
+
+	// Gather all crossings of both objects from the start of the interval on. An object whose
+	// first crossing is a back face already contains the start of the interval.
+	searchIntvl := Interval{intvl.min, math.MaxFloat64}
+	recsA := HitAll(hit.a, r, searchIntvl)
+	recsB := HitAll(hit.b, r, searchIntvl)
+	inA := len(recsA) > 0 && !recsA[0].frontFace
+	inB := len(recsB) > 0 && !recsB[0].frontFace
+	inside := hit.Inside(inA, inB)
+
+	// Walk the crossings in order, and report the first one where the combined solid is
+	// entered or left.
+	i, j := 0, 0
+	for i < len(recsA) || j < len(recsB) {
+		var rec HitRecord
+		fromB := j < len(recsB) && (i >= len(recsA) || recsB[j].t < recsA[i].t)
+		if fromB {
+			rec = recsB[j]
+			inB = rec.frontFace
+			j++
+		} else {
+			rec = recsA[i]
+			inA = rec.frontFace
+			i++
+		}
+
+		if rec.t > intvl.max {
+			break
+		}
+
+		if hit.Inside(inA, inB) == inside {
+			continue
+		}
+		inside = !inside
+
+		// The surface of the subtracted object faces into the result, so flip its orientation.
+		// The hit normal keeps facing the ray, only the side it belongs to changes.
+		if fromB && hit.op == CSGDifference {
+			rec.frontFace = !rec.frontFace
+			rec.objectNormal = rec.objectNormal.Muln(-1)
+		}
+		return true, rec
+	}
+
+	return false, HitRecord{}
+}
+
+func (hit CSG) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit CSG) PDFValue(origin Point3, direction Vec3) float64 {
+	return 0
+}
+
+func (hit CSG) Random(origin Point3, s Sampler) Vec3 {
+	return Vec3{1, 0, 0}
+}
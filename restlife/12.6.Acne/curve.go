@@ -0,0 +1,342 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+type CurveType int
+
+const (
+	CurveFlat     CurveType = iota // Flat strip always facing the ray, for thin hair seen from afar
+	CurveCylinder                  // Flat strip shaded as if it were a round tube
+	CurveRibbon                    // Strip oriented by normals given at its ends, like a grass blade
+)
+
+// Number of pieces a curve is split into, each with its own tight bounding box for the BVH.
+const CurveSegments = 4
+
+type Curve struct {
+	cp        [4]Point3 // Bezier control points of this piece of the curve
+	u0, u1    float64   // Range of the whole curve covered by this piece
+	width     [2]float64
+	normals   [2]Vec3 // Ribbon normals at both ends of the whole curve
+	normalAng float64 // Angle between the ribbon normals
+	curveType CurveType
+	mat       Material
+	bbox      AABB
+	maxDepth  int // Subdivisions needed to flatten the piece into a line
+}
+
+func NewCurve(cp [4]Point3, width0, width1 float64, curveType CurveType, mat Material) HittableList {
+	// A cubic Bezier curve whose width goes from width0 at its start to width1 at its end.
+	return NewCurveSegments(cp, [2]float64{width0, width1}, [2]Vec3{}, curveType, mat)
+}
+
+func NewRibbon(cp [4]Point3, width0, width1 float64, n0, n1 Vec3, mat Material) HittableList {
+	// A ribbon along the curve facing n0 at its start and n1 at its end. The normals should be
+	// perpendicular to the curve.
+	return NewCurveSegments(cp, [2]float64{width0, width1}, [2]Vec3{n0.Normalize(), n1.Normalize()}, CurveRibbon, mat)
+}
+
+func NewCurveSegments(cp [4]Point3, width [2]float64, normals [2]Vec3, curveType CurveType, mat Material) HittableList {
+	list := HittableList{}
+	normalAng := math.Acos(Clamp(normals[0].Dot(normals[1]), -1, 1))
+	for i := range CurveSegments {
+		u0, u1 := float64(i)/CurveSegments, float64(i+1)/CurveSegments
+		seg := Curve{u0: u0, u1: u1, width: width, normals: normals, normalAng: normalAng, curveType: curveType, mat: mat}
+		seg.cp = BezierSegment(cp, u0, u1)
+
+		// Bound the control points, widened by half the largest width over the piece.
+		halfWidth := Vec3{1, 1, 1}.Muln(math.Max(seg.Width(u0), seg.Width(u1)) / 2)
+		seg.bbox = EmptyAABB
+		for _, p := range seg.cp {
+			seg.bbox = NewAABBBox(seg.bbox, NewAABBPoint(p.Sub(halfWidth), p.Add(halfWidth)))
+		}
+
+		// Choose the subdivision depth from the curvature of the piece, like pbrt does.
+		l0 := 0.0
+		for j := range 2 {
+			d := seg.cp[j].Sub(seg.cp[j+1].Muln(2)).Add(seg.cp[j+2])
+			l0 = math.Max(l0, math.Max(math.Abs(d.X()), math.Max(math.Abs(d.Y()), math.Abs(d.Z()))))
+		}
+		eps := math.Max(width[0], width[1]) * 0.05
+		if l0 > 0 && eps > 0 {
+			seg.maxDepth = Clamp(int(math.Log2(math.Sqrt2*6*l0/(8*eps))/2), 0, 10)
+		}
+
+		list.Add(seg)
+	}
+	return list
+}
+
+func BlossomBezier(cp [4]Point3, u0, u1, u2 float64) Point3 {
+	// Polar form of the Bezier curve, which gives the control points of any piece of it.
+	a := [3]Point3{Lerp(cp[0], cp[1], u0), Lerp(cp[1], cp[2], u0), Lerp(cp[2], cp[3], u0)}
+	b := [2]Point3{Lerp(a[0], a[1], u1), Lerp(a[1], a[2], u1)}
+	return Lerp(b[0], b[1], u2)
+}
+
+func BezierSegment(cp [4]Point3, u0, u1 float64) [4]Point3 {
+	return [4]Point3{
+		BlossomBezier(cp, u0, u0, u0),
+		BlossomBezier(cp, u0, u0, u1),
+		BlossomBezier(cp, u0, u1, u1),
+		BlossomBezier(cp, u1, u1, u1),
+	}
+}
+
+func SplitBezier(cp [4]Point3) ([4]Point3, [4]Point3) {
+	// Splits the curve in two halves at its middle.
+	a := [3]Point3{Lerp(cp[0], cp[1], 0.5), Lerp(cp[1], cp[2], 0.5), Lerp(cp[2], cp[3], 0.5)}
+	b := [2]Point3{Lerp(a[0], a[1], 0.5), Lerp(a[1], a[2], 0.5)}
+	mid := Lerp(b[0], b[1], 0.5)
+	return [4]Point3{cp[0], a[0], b[0], mid}, [4]Point3{mid, b[1], a[2], cp[3]}
+}
+
+func EvalBezier(cp [4]Point3, u float64) (Point3, Vec3) {
+	// Returns the point on the curve at u, and the derivative there.
+	a := [3]Point3{Lerp(cp[0], cp[1], u), Lerp(cp[1], cp[2], u), Lerp(cp[2], cp[3], u)}
+	b := [2]Point3{Lerp(a[0], a[1], u), Lerp(a[1], a[2], u)}
+	derivative := b[1].Sub(b[0]).Muln(3)
+	if derivative.NearZero() {
+		// Coincident control points at an end, use the chord instead.
+		derivative = cp[3].Sub(cp[0])
+	}
+	return Lerp(b[0], b[1], u), derivative
+}
+
+func (hit Curve) Width(u float64) float64 {
+	return hit.width[0]*(1-u) + hit.width[1]*u
+}
+
+func (hit Curve) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	if !hit.bbox.Hit(r, intvl) {
+		return false, HitRecord{}
+	}
+
+	// Work in a right handed frame looking down the ray, where the ray is the z axis and the
+	// curve is hit where it passes within half its width of the axis.
+	rayLength := r.dir.Length()
+	onb := NewONB(r.dir)
+	frame := ONB{onb.V().Cross(onb.W()), onb.V(), onb.W()}
+	var cp [4]Point3
+	for i, p := range hit.cp {
+		cp[i] = frame.ToLocal(p.Sub(r.orig))
+	}
+
+	return hit.RecursiveHit(r, frame, cp, hit.u0, hit.u1, hit.maxDepth, Interval{intvl.min * rayLength, intvl.max * rayLength})
+}
+
+func (hit Curve) RecursiveHit(r Ray, frame ONB, cp [4]Point3, u0, u1 float64, depth int, zRange Interval) (bool, HitRecord) {
+	// Skip the piece if its bounds, widened by its width, miss the ray.
+	halfWidth := math.Max(hit.Width(u0), hit.Width(u1)) / 2
+	low := Point3{math.Inf(1), math.Inf(1), math.Inf(1)}
+	high := Point3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range cp {
+		for axis := range 3 {
+			low[axis] = math.Min(low[axis], p[axis]-halfWidth)
+			high[axis] = math.Max(high[axis], p[axis]+halfWidth)
+		}
+	}
+	if low.X() > 0 || high.X() < 0 || low.Y() > 0 || high.Y() < 0 || low.Z() > zRange.max || high.Z() < zRange.min {
+		return false, HitRecord{}
+	}
+
+	if depth > 0 {
+		// Split the piece and try both halves, keeping the closest hit.
+		first, second := SplitBezier(cp)
+		mid := (u0 + u1) / 2
+		found, rec := hit.RecursiveHit(r, frame, first, u0, mid, depth-1, zRange)
+		if found {
+			zRange.max = rec.t * r.dir.Length()
+		}
+		if ok, rec2 := hit.RecursiveHit(r, frame, second, mid, u1, depth-1, zRange); ok {
+			return true, rec2
+		}
+		return found, rec
+	}
+
+	return hit.HitSegment(r, frame, cp, u0, u1, zRange)
+}
+
+func (hit Curve) HitSegment(r Ray, frame ONB, cp [4]Point3, u0, u1 float64, zRange Interval) (bool, HitRecord) {
+	// Intersects the ray with a piece flat enough to be treated as the line from its first to
+	// its last control point.
+
+	// Reject hits beyond the ends of the piece, they belong to its neighbors.
+	edge := (cp[1].Y()-cp[0].Y())*-cp[0].Y() + cp[0].X()*(cp[0].X()-cp[1].X())
+	if edge < 0 {
+		return false, HitRecord{}
+	}
+	edge = (cp[2].Y()-cp[3].Y())*-cp[3].Y() + cp[3].X()*(cp[3].X()-cp[2].X())
+	if edge < 0 {
+		return false, HitRecord{}
+	}
+
+	// Find the parameter w of the closest point of the line to the ray.
+	segment := Vec3{cp[3].X() - cp[0].X(), cp[3].Y() - cp[0].Y(), 0}
+	denom := segment.Dot(segment)
+	if denom == 0 {
+		return false, HitRecord{}
+	}
+	w := Vec3{-cp[0].X(), -cp[0].Y(), 0}.Dot(segment) / denom
+	u := Clamp(u0+(u1-u0)*w, u0, u1)
+	hitWidth := hit.Width(u)
+
+	// Ribbons look narrower when seen at a grazing angle.
+	var ribbonNormal Vec3
+	if hit.curveType == CurveRibbon {
+		ribbonNormal = hit.RibbonNormal(u)
+		hitWidth *= math.Abs(ribbonNormal.Dot(r.dir)) / r.dir.Length()
+	}
+
+	pc, dpcdw := EvalBezier(cp, Clamp(w, 0, 1))
+	distance2 := pc.X()*pc.X() + pc.Y()*pc.Y()
+	if hitWidth <= 0 || distance2 > hitWidth*hitWidth/4 || !zRange.Surrounds(pc.Z()) {
+		return false, HitRecord{}
+	}
+
+	// The v coordinate runs across the width, 0.5 being the middle of the curve.
+	distance := math.Sqrt(distance2)
+	v := 0.5 - distance/hitWidth
+	if dpcdw.X()*-pc.Y()+pc.X()*dpcdw.Y() > 0 {
+		v = 0.5 + distance/hitWidth
+	}
+
+	rec := HitRecord{}
+	rec.t = pc.Z() / r.dir.Length()
+	rec.p = r.At(rec.t)
+	rec.u, rec.v = u, v
+	rec.mat = hit.mat
+
+	// Tangents along and across the curve, the normal being their cross product.
+	_, dpdu := EvalBezier(hit.cp, (u-hit.u0)/(hit.u1-hit.u0))
+	dpdu = dpdu.Divn(hit.u1 - hit.u0)
+	var dpdv Vec3
+	flip := false
+	if hit.curveType == CurveRibbon {
+		dpdv = ribbonNormal.Cross(dpdu).Normalize().Muln(hitWidth)
+	} else {
+		// Flat curves face the ray, cylinders turn their normal across the width like a tube.
+		dpduPlane := frame.ToLocal(dpdu)
+		dpdvPlane := Vec3{-dpduPlane.Y(), dpduPlane.X(), 0}.Normalize().Muln(hitWidth)
+		flip = dpdu.Cross(frame.Transform(dpdvPlane)).Dot(r.dir) > 0
+		if hit.curveType == CurveCylinder {
+			theta := -90 + 180*v
+			dpdvPlane = RotationAxis(dpduPlane, theta).Vector(dpdvPlane)
+		}
+		dpdv = frame.Transform(dpdvPlane)
+	}
+	rec.dpdu, rec.dpdv = dpdu, dpdv
+
+	outwardNormal := dpdu.Cross(dpdv).Normalize()
+	if flip {
+		outwardNormal = outwardNormal.Muln(-1)
+	}
+	rec.SetFaceNormal(r, outwardNormal)
+	rec.objectP, rec.objectNormal = rec.p, outwardNormal
+
+	return true, rec
+}
+
+func (hit Curve) RibbonNormal(u float64) Vec3 {
+	// Spherical interpolation between the normals at both ends.
+	if hit.normalAng < 1e-6 {
+		return hit.normals[0]
+	}
+	invSin := 1 / math.Sin(hit.normalAng)
+	sin0 := math.Sin((1-u)*hit.normalAng) * invSin
+	sin1 := math.Sin(u*hit.normalAng) * invSin
+	return hit.normals[0].Muln(sin0).Add(hit.normals[1].Muln(sin1))
+}
+
+func (hit Curve) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Curve) PDFValue(origin Point3, direction Vec3) float64 {
+	return 0
+}
+
+func (hit Curve) Random(origin Point3, s Sampler) Vec3 {
+	return Vec3{1, 0, 0}
+}
+
+// A SurfaceSampler returns uniformly distributed points on a surface, with the normal there.
+type SurfaceSampler func() (Point3, Vec3)
+
+func PlanarSampler(planar Planar) SurfaceSampler {
+	return func() (Point3, Vec3) {
+		return planar.Random(Point3{}, IndependentSampler{}), planar.normal
+	}
+}
+
+func MeshSampler(mesh Mesh) SurfaceSampler {
+	// Picks triangles in proportion to their area, and interpolates the vertex normals.
+	normals := mesh.Normals()
+	var triangles [][3]int
+	var cdf []float64
+	total := 0.0
+	for _, face := range mesh.faces {
+		for i := 1; i+1 < len(face); i++ {
+			k := [3]int{face[0], face[i], face[i+1]}
+			p0, p1, p2 := mesh.positions[k[0]], mesh.positions[k[1]], mesh.positions[k[2]]
+			total += p1.Sub(p0).Cross(p2.Sub(p0)).Length() / 2
+			triangles = append(triangles, k)
+			cdf = append(cdf, total)
+		}
+	}
+
+	return func() (Point3, Vec3) {
+		x := rand.Float64() * total
+		lo, hi := 0, len(cdf)-1
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if cdf[mid] < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		k := triangles[lo]
+		a, b := rand.Float64(), rand.Float64()
+		if a+b > 1 {
+			a, b = 1-a, 1-b
+		}
+		p0, p1, p2 := mesh.positions[k[0]], mesh.positions[k[1]], mesh.positions[k[2]]
+		p := p0.Add(p1.Sub(p0).Muln(a)).Add(p2.Sub(p0).Muln(b))
+		n := normals[k[0]].Muln(1 - a - b).Add(normals[k[1]].Muln(a)).Add(normals[k[2]].Muln(b))
+		return p, n.Normalize()
+	}
+}
+
+func NewGrass(sampler SurfaceSampler, count int, height, width float64, mat Material) BVHNode {
+	// Scatters count blades of grass over a surface. Every blade is a ribbon tapering to a
+	// point, of random height around the given one, that curls over toward the way it faces.
+	blades := HittableList{}
+	for range count {
+		base, up := sampler()
+		phi := 2 * math.Pi * rand.Float64()
+		facing := NewONB(up).Transform(Vec3{math.Cos(phi), math.Sin(phi), 0})
+		h := height * RandomRange(0.6, 1.4)
+		bend := RandomRange(0.1, 0.6)
+
+		cp := [4]Point3{
+			base,
+			base.Add(up.Muln(h / 3)),
+			base.Add(up.Muln(h * 2 / 3)).Add(facing.Muln(h * bend / 2)),
+			base.Add(up.Muln(h * (1 - bend/3))).Add(facing.Muln(h * bend)),
+		}
+
+		// Keep the normal at the tip perpendicular to the curled over blade.
+		_, tip := EvalBezier(cp, 1)
+		tip = tip.Normalize()
+		tipNormal := facing.Sub(tip.Muln(facing.Dot(tip))).Normalize()
+
+		for _, seg := range NewRibbon(cp, width, 0, facing, tipNormal, mat).objects {
+			blades.Add(seg)
+		}
+	}
+	return NewBVHNode(blades)
+}
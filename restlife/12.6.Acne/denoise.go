@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"slices"
+)
+
+// Whether to write a denoised image next to the image, from the command line.
+var DenoiseImage bool
+
+const (
+	DenoiseIterations  = 4    // Passes of the wavelet filter, its footprint doubling every pass
+	DenoiseNormalPower = 32.0 // Sharpness of the normal weight, higher keeping more of the edges
+	DenoiseLuminance   = 2.0  // Differences in brightness tolerated, in standard deviations of the noise
+)
+
+func Denoise(pixels, albedo, normal []RGB, variance []float64, width, height int) ([]RGB, error) {
+	// Denoises the image with the edge avoiding à-trous wavelet filter of SVGF. The light is
+	// divided by the albedo first, so textures stay sharp while the light reaching them is
+	// filtered, then every pass blurs the light with a 5x5 B-spline kernel whose taps spread
+	// twice as far as in the pass before. Taps are weighted down across edges of the normals
+	// and where the brightness differs by more than the noise, whose variance is carried
+	// through the passes. The brightness is compared once blurred, as the noise of path
+	// tracing has rare bright samples which would otherwise be left out, darkening the image.
+	// The albedo and normals may be nil, and the variance of the mean of the brightness of
+	// every pixel too, estimated from the image then. Those given must have a value for every
+	// pixel, like the image.
+	n := width * height
+	switch {
+	case len(pixels) != n:
+		return nil, fmt.Errorf("denoise: %d pixels for a %dx%d image", len(pixels), width, height)
+	case albedo != nil && len(albedo) != n:
+		return nil, fmt.Errorf("denoise: %d albedo values for a %dx%d image", len(albedo), width, height)
+	case normal != nil && len(normal) != n:
+		return nil, fmt.Errorf("denoise: %d normals for a %dx%d image", len(normal), width, height)
+	case variance != nil && len(variance) != n:
+		return nil, fmt.Errorf("denoise: %d variances for a %dx%d image", len(variance), width, height)
+	}
+	light := make([]RGB, n)
+	lightVariance := make([]float64, n)
+	if variance == nil {
+		variance = LocalVariance(pixels, width, height)
+	}
+	for k := range n {
+		light[k], lightVariance[k] = pixels[k], variance[k]
+		if albedo != nil {
+			a := Demodulation(albedo[k])
+			light[k] = RGB{pixels[k][0] / a[0], pixels[k][1] / a[1], pixels[k][2] / a[2]}
+			lightVariance[k] = variance[k] / (a.Average() * a.Average())
+		}
+	}
+
+	var unit []Vec3
+	if normal != nil {
+		unit = make([]Vec3, n)
+		for k, v := range normal {
+			if v.Length() > 0 {
+				unit[k] = v.Normalize()
+			}
+		}
+	}
+
+	kernel := [5]float64{1.0 / 16, 1.0 / 4, 3.0 / 8, 1.0 / 4, 1.0 / 16}
+	next, nextVariance := make([]RGB, n), make([]float64, n)
+	for pass := range DenoiseIterations {
+		step := 1 << pass
+		luminance := make([]float64, n)
+		for k := range n {
+			luminance[k] = light[k].Average()
+		}
+		luminance = Blur(luminance, width, height)
+		blurredVariance := Blur(lightVariance, width, height)
+		for j := range height {
+			for i := range width {
+				p := i + j*width
+				sigma := DenoiseLuminance*math.Sqrt(blurredVariance[p]) + 1e-6
+
+				sum, weights, sumVariance := RGB{0, 0, 0}, 0.0, 0.0
+				for dy := -2; dy <= 2; dy++ {
+					y := j + dy*step
+					if y < 0 || y >= height {
+						continue
+					}
+					for dx := -2; dx <= 2; dx++ {
+						x := i + dx*step
+						if x < 0 || x >= width {
+							continue
+						}
+						q := x + y*width
+						w := kernel[dx+2] * kernel[dy+2] * math.Exp(-math.Abs(luminance[p]-luminance[q])/sigma)
+						if unit != nil {
+							w *= NormalWeight(unit[p], unit[q])
+						}
+						sum = sum.Add(light[q].Muln(w))
+						weights += w
+						sumVariance += w * w * lightVariance[q]
+					}
+				}
+				// The center tap always has some weight, unless the normals are broken.
+				if weights <= 0 {
+					next[p], nextVariance[p] = light[p], lightVariance[p]
+					continue
+				}
+				next[p] = sum.Divn(weights)
+				nextVariance[p] = sumVariance / (weights * weights)
+			}
+		}
+		light, next = next, light
+		lightVariance, nextVariance = nextVariance, lightVariance
+	}
+
+	denoised := make([]RGB, n)
+	for k := range n {
+		denoised[k] = light[k]
+		if albedo != nil {
+			denoised[k] = light[k].Mul(Demodulation(albedo[k]))
+		}
+	}
+	return denoised, nil
+}
+
+func Demodulation(albedo RGB) RGB {
+	// Returns the albedo the light is divided by, black surfaces and the background keeping
+	// their color.
+	for k := range albedo {
+		if albedo[k] < 0.01 {
+			albedo[k] = 1
+		}
+	}
+	return albedo
+}
+
+func NormalWeight(a, b Vec3) float64 {
+	// Pixels where the ray escaped have no normal, and only go with each other.
+	if a == (Vec3{}) || b == (Vec3{}) {
+		if a == b {
+			return 1
+		}
+		return 0
+	}
+	return math.Pow(math.Max(0, a.Dot(b)), DenoiseNormalPower)
+}
+
+func Blur(values []float64, width, height int) []float64 {
+	// Blurs the values with a 3x3 Gaussian kernel, steadying the brightness weights of the
+	// filter.
+	kernel := [3]float64{1.0 / 4, 1.0 / 2, 1.0 / 4}
+	blurred := make([]float64, len(values))
+	for j := range height {
+		for i := range width {
+			sum, weights := 0.0, 0.0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					x, y := i+dx, j+dy
+					if x < 0 || x >= width || y < 0 || y >= height {
+						continue
+					}
+					w := kernel[dx+1] * kernel[dy+1]
+					sum += w * values[x+y*width]
+					weights += w
+				}
+			}
+			blurred[i+j*width] = sum / weights
+		}
+	}
+	return blurred
+}
+
+func LocalVariance(pixels []RGB, width, height int) []float64 {
+	// Estimates the variance of the brightness of every pixel, for images without sample
+	// statistics. The noise is what a 3x3 median filter takes away, the median keeping edges,
+	// and its variance the median of its square over the 5x5 neighborhood, which leaves out
+	// the rare bright samples. The median of the square of a normal variable is 0.455 times
+	// its variance.
+	luminance := make([]float64, len(pixels))
+	for k, p := range pixels {
+		luminance[k] = p.Average()
+	}
+	window := make([]float64, 0, 25)
+	median := func(values []float64) float64 {
+		slices.Sort(values)
+		return values[len(values)/2]
+	}
+
+	residual := make([]float64, len(pixels))
+	for j := range height {
+		for i := range width {
+			window = window[:0]
+			for y := max(j-1, 0); y <= min(j+1, height-1); y++ {
+				for x := max(i-1, 0); x <= min(i+1, width-1); x++ {
+					window = append(window, luminance[x+y*width])
+				}
+			}
+			r := luminance[i+j*width] - median(window)
+			residual[i+j*width] = r * r
+		}
+	}
+
+	variance := make([]float64, len(pixels))
+	for j := range height {
+		for i := range width {
+			window = window[:0]
+			for y := max(j-2, 0); y <= min(j+2, height-1); y++ {
+				for x := max(i-2, 0); x <= min(i+2, width-1); x++ {
+					window = append(window, residual[x+y*width])
+				}
+			}
+			variance[i+j*width] = median(window) / 0.455
+		}
+	}
+	return variance
+}
+
+func (c *Camera) WriteDenoised(film Film) {
+	// Writes the denoised image, as a PNG and as floats, guided by the albedo and normal AOVs
+	// of the camera if it has them, and by the variance of the samples of every pixel.
+	n := c.imageWidth * c.imageHeight
+	layer := func(a AOV) []RGB {
+		l := slices.Index(c.aovs, a)
+		if l < 0 {
+			return nil
+		}
+		values := make([]RGB, n)
+		for j := range c.imageHeight {
+			for i := range c.imageWidth {
+				values[i+j*c.imageWidth] = film.Layer(l, i, j)
+			}
+		}
+		return values
+	}
+	albedo, normal := layer(AOVAlbedo), layer(AOVNormal)
+
+	pixels := make([]RGB, n)
+	variance := make([]float64, n)
+	for j := range c.imageHeight {
+		for i := range c.imageWidth {
+			pixels[i+j*c.imageWidth] = film.Pixel(i, j)
+			variance[i+j*c.imageWidth] = film.Variance(i, j)
+		}
+	}
+
+	denoised, err := Denoise(pixels, albedo, normal, variance, c.imageWidth, c.imageHeight)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	framebuffer := make([]color.Color, n)
+	for k, p := range denoised {
+		framebuffer[k] = p.Color()
+	}
+	WritePng("3-12.6-denoised", framebuffer, c.imageWidth, c.imageHeight)
+	WritePfm("3-12.6-denoised", denoised, c.imageWidth, c.imageHeight)
+}
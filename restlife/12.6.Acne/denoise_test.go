@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math"
+	"sync"
+	"testing"
+)
+
+const (
+	DenoiseTestWidth     = 64  // Width and height of the test renders of the Cornell box
+	DenoiseTestSamples   = 16  // Samples of every pixel of the noisy renders
+	DenoiseTestReference = 256 // Samples of every pixel of the reference render
+)
+
+// A DenoiseTestImage is a render of the Cornell box, with everything the denoiser can use.
+type DenoiseTestImage struct {
+	pixels   []RGB
+	albedo   []RGB
+	normal   []RGB
+	variance []float64
+}
+
+func RenderDenoiseTestImage(samplesPerPixel int, aovs []AOV) DenoiseTestImage {
+	// Renders the Cornell box with every pixel taking the same number of samples, keeping the
+	// albedo and normals if the AOVs have them.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	world, lights, cam := CornellBoxScene()
+	cam.imageWidth = DenoiseTestWidth
+	cam.samplesPerPixel = samplesPerPixel
+	cam.adaptiveThreshold = 0
+	cam.aovs = aovs
+	cam.Initialize()
+
+	film := NewFilm(cam.imageWidth, cam.imageHeight, cam.filter, cam.aovs)
+	counts := make([]int, cam.imageWidth*cam.imageHeight)
+	cam.RenderPasses(&film, counts, world, lights)
+
+	n := cam.imageWidth * cam.imageHeight
+	image := DenoiseTestImage{pixels: make([]RGB, n), variance: make([]float64, n)}
+	for l, a := range aovs {
+		values := make([]RGB, n)
+		for j := range cam.imageHeight {
+			for i := range cam.imageWidth {
+				values[i+j*cam.imageWidth] = film.Layer(l, i, j)
+			}
+		}
+		switch a {
+		case AOVAlbedo:
+			image.albedo = values
+		case AOVNormal:
+			image.normal = values
+		}
+	}
+	for j := range cam.imageHeight {
+		for i := range cam.imageWidth {
+			image.pixels[i+j*cam.imageWidth] = film.Pixel(i, j)
+			image.variance[i+j*cam.imageWidth] = film.Variance(i, j)
+		}
+	}
+	return image
+}
+
+// The renders are shared by the tests, the reference taking a while.
+var (
+	DenoiseTestReferenceImage = sync.OnceValue(func() DenoiseTestImage {
+		return RenderDenoiseTestImage(DenoiseTestReference, nil)
+	})
+	DenoiseTestNoisyImage = sync.OnceValue(func() DenoiseTestImage {
+		return RenderDenoiseTestImage(DenoiseTestSamples, []AOV{AOVAlbedo, AOVNormal})
+	})
+)
+
+func ImageError(a, b []RGB) float64 {
+	// Returns the mean squared error between the images, clamped to the colors they show as
+	// so the rare very bright samples of the noisy images don't outweigh everything else.
+	sum := 0.0
+	for k := range a {
+		for c := range a[k] {
+			d := Clamp(a[k][c], 0, 1) - Clamp(b[k][c], 0, 1)
+			sum += d * d
+		}
+	}
+	return sum / float64(3*len(a))
+}
+
+func TestDenoiseReducesError(t *testing.T) {
+	if testing.Short() {
+		t.Skip("renders the Cornell box")
+	}
+	reference := DenoiseTestReferenceImage()
+	noisy := DenoiseTestNoisyImage()
+	plain := RenderDenoiseTestImage(DenoiseTestSamples, nil)
+
+	for _, test := range []struct {
+		name  string
+		image DenoiseTestImage
+	}{
+		{"with AOVs", noisy},
+		{"without AOVs", plain},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			image := test.image
+			denoised, err := Denoise(image.pixels, image.albedo, image.normal, image.variance, DenoiseTestWidth, DenoiseTestWidth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			noisyError, denoisedError := ImageError(image.pixels, reference.pixels), ImageError(denoised, reference.pixels)
+			t.Logf("noisy MSE %.6f, denoised MSE %.6f", noisyError, denoisedError)
+			if denoisedError > noisyError/2 {
+				t.Errorf("denoised MSE %.6f isn't well below the noisy MSE %.6f", denoisedError, noisyError)
+			}
+		})
+	}
+}
+
+func TestDenoiseWithoutGuides(t *testing.T) {
+	// Any of the albedo, the normals and the variance can be left out, the denoiser doing
+	// without them.
+	if testing.Short() {
+		t.Skip("renders the Cornell box")
+	}
+	reference := DenoiseTestReferenceImage()
+	noisy := DenoiseTestNoisyImage()
+	noisyError := ImageError(noisy.pixels, reference.pixels)
+
+	for _, test := range []struct {
+		name     string
+		albedo   []RGB
+		normal   []RGB
+		variance []float64
+	}{
+		{"nil albedo", nil, noisy.normal, noisy.variance},
+		{"nil normal", noisy.albedo, nil, noisy.variance},
+		{"nil variance", noisy.albedo, noisy.normal, nil},
+		{"nil everything", nil, nil, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			denoised, err := Denoise(noisy.pixels, test.albedo, test.normal, test.variance, DenoiseTestWidth, DenoiseTestWidth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(denoised) != len(noisy.pixels) {
+				t.Fatalf("denoised image has %d pixels, want %d", len(denoised), len(noisy.pixels))
+			}
+			for k, p := range denoised {
+				for _, v := range p {
+					if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+						t.Fatalf("pixel %d is %v", k, p)
+					}
+				}
+			}
+			if denoisedError := ImageError(denoised, reference.pixels); denoisedError >= noisyError {
+				t.Errorf("denoised MSE %.6f isn't below the noisy MSE %.6f", denoisedError, noisyError)
+			}
+		})
+	}
+}
+
+func TestDenoiseChecksLengths(t *testing.T) {
+	const width, height = 4, 3
+	pixels := make([]RGB, width*height)
+	short := make([]RGB, width*height-1)
+	for _, test := range []struct {
+		name     string
+		pixels   []RGB
+		albedo   []RGB
+		normal   []RGB
+		variance []float64
+	}{
+		{"pixels", short, nil, nil, nil},
+		{"albedo", pixels, short, nil, nil},
+		{"normal", pixels, nil, short, nil},
+		{"variance", pixels, nil, nil, make([]float64, width*height+1)},
+	} {
+		if _, err := Denoise(test.pixels, test.albedo, test.normal, test.variance, width, height); err == nil {
+			t.Errorf("Denoise took %s of the wrong length", test.name)
+		}
+	}
+	if _, err := Denoise(pixels, nil, nil, nil, width, height); err != nil {
+		t.Errorf("Denoise refused a black image: %v", err)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings of distributed renders, from the command line. The scenes are Go code, so rather
+// than the scene itself the coordinator sends its workers the number of the scene, which they
+// build themselves, and its hash, which the scene they build must match.
+var (
+	CoordinatorAddress string // Address the coordinator serves its workers on, rendering alone when empty
+	CoordinatorURL     string // URL of the coordinator this process works for, when it's a worker
+	SceneNumber        int    // Scene being rendered
+	WorkerJob          Job    // Job a worker got from its coordinator
+)
+
+// Client of the requests of the workers, which give up on a coordinator that stopped answering
+// rather than hanging on it.
+var WorkerClient = &http.Client{Timeout: time.Minute}
+
+const (
+	TileSize          = 32               // Width and height of the tiles of work units, in pixels
+	TileSamples       = 64               // Samples of every pixel of a tile rendered in one work unit
+	LeaseDuration     = 30 * time.Second // Time without news from a worker before its unit is handed out again
+	HeartbeatInterval = 5 * time.Second  // Time between the heartbeats of a worker rendering a unit
+	WorkerRetries     = 30               // Failed requests in a row after which a worker gives up on its coordinator
+)
+
+// A Job tells a worker what to render.
+type Job struct {
+	Scene     int
+	SceneHash uint64
+}
+
+// A WorkUnit is a tile of the image and a range of sample indices to render in its pixels.
+// The stratified, Halton, Sobol and blue noise samplers give the same values for the same
+// pixel and sample index on every machine, so the units of a tile add up to the samples a
+// single machine would take. With the independent sampler, or objects drawing from the global
+// random numbers like media, they only add up to the same image statistically. Pixels that
+// had samples at the start of the render, from a checkpoint, skip the indices they already have.
+type WorkUnit struct {
+	ID             int
+	X0, Y0, X1, Y1 int   // Pixels of the tile, from (X0, Y0) included to (X1, Y1) excluded
+	First, Last    int   // Sample indices, from First included to Last excluded
+	Start          []int // Samples of the pixels of the tile at the start of the render
+}
+
+func (u WorkUnit) Samples(i, j int) (int, int) {
+	// Returns the range of sample indices of the pixel in the unit.
+	return max(u.First, u.Start[i-u.X0+(j-u.Y0)*(u.X1-u.X0)]), u.Last
+}
+
+// A UnitResult is the film of a rendered unit, covering its tile and the margin around it
+// its samples were splatted into. The floating point sums are sent rather than colors, so
+// the coordinator merges them as if it had taken the samples itself.
+type UnitResult struct {
+	ID                    int
+	X0, Y0, Width, Height int
+	Sum                   []RGB
+	Weight                []float64
+	Count                 []int
+	Mean                  []float64
+	M2                    []float64
+	Layers                [][]RGB
+}
+
+func (r UnitResult) Film(filter PixelFilter, aovs []AOV) Film {
+	return Film{r.X0, r.Y0, r.Width, r.Height, filter, r.Sum, r.Weight, r.Count, r.Mean, r.M2, aovs, r.Layers}
+}
+
+func (c *Camera) WorkUnits(counts []int) []WorkUnit {
+	// Splits the samples still to take into units, sample range after sample range, so the
+	// whole image progresses together and snapshots show all of it.
+	var units []WorkUnit
+	for first := 0; first < c.samplesPerPixel; first += TileSamples {
+		last := min(first+TileSamples, c.samplesPerPixel)
+		for y0 := 0; y0 < c.imageHeight; y0 += TileSize {
+			for x0 := 0; x0 < c.imageWidth; x0 += TileSize {
+				x1, y1 := min(x0+TileSize, c.imageWidth), min(y0+TileSize, c.imageHeight)
+				start := make([]int, 0, (x1-x0)*(y1-y0))
+				needed := false
+				for j := y0; j < y1; j++ {
+					for i := x0; i < x1; i++ {
+						count := counts[i+j*c.imageWidth]
+						start = append(start, count)
+						needed = needed || count < last
+					}
+				}
+				if needed {
+					units = append(units, WorkUnit{len(units), x0, y0, x1, y1, first, last, start})
+				}
+			}
+		}
+	}
+	return units
+}
+
+// The Coordinator hands out work units to the workers asking for them, and passes their
+// results on. Every unit handed out is leased to its worker, which renews the lease with
+// heartbeats while it renders. Units whose lease runs out, their worker having died or lost
+// its connection, are handed out again, and only the first result of a unit is kept.
+type Coordinator struct {
+	mu      sync.Mutex
+	job     Job
+	units   []WorkUnit
+	pending []int             // Units not handed out yet, in order
+	leases  map[int]time.Time // End of the lease of every unit being rendered
+	done    []bool
+	stopped bool          // No more units are handed out
+	layers  int           // AOVs in the films of the results
+	lease   time.Duration // Time without news from a worker before its unit is handed out again
+	results chan UnitResult
+}
+
+func NewCoordinator(job Job, units []WorkUnit, layers int, lease time.Duration) *Coordinator {
+	co := &Coordinator{
+		job:     job,
+		units:   units,
+		layers:  layers,
+		lease:   lease,
+		leases:  map[int]time.Time{},
+		done:    make([]bool, len(units)),
+		results: make(chan UnitResult, len(units)),
+	}
+	for id := range units {
+		co.pending = append(co.pending, id)
+	}
+	return co
+}
+
+func (co *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /job", co.ServeJob)
+	mux.HandleFunc("POST /unit", co.ServeUnit)
+	mux.HandleFunc("POST /heartbeat", co.ServeHeartbeat)
+	mux.HandleFunc("POST /result", co.ServeResult)
+	return mux
+}
+
+func (co *Coordinator) ServeJob(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Worker %s joined", r.FormValue("worker"))
+	gob.NewEncoder(w).Encode(co.job)
+}
+
+func (co *Coordinator) ServeUnit(w http.ResponseWriter, r *http.Request) {
+	// Hands out the next unit. Workers are told to come back later when all the units are
+	// leased, as some may be handed out again, and to leave once the render is over.
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.expire()
+	switch {
+	case co.finished():
+		w.WriteHeader(http.StatusGone)
+		return
+	case len(co.pending) == 0:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := co.pending[0]
+	co.pending = co.pending[1:]
+	co.leases[id] = time.Now().Add(co.lease)
+	gob.NewEncoder(w).Encode(co.units[id])
+}
+
+func (co *Coordinator) ServeHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("unit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if _, ok := co.leases[id]; !ok {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	co.leases[id] = time.Now().Add(co.lease)
+}
+
+func (co *Coordinator) ServeResult(w http.ResponseWriter, r *http.Request) {
+	var result UnitResult
+	if err := gob.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if result.ID < 0 || result.ID >= len(co.units) {
+		http.Error(w, fmt.Sprintf("no unit %d", result.ID), http.StatusBadRequest)
+		return
+	}
+	n := result.Width * result.Height
+	if len(result.Sum) != n || len(result.Weight) != n || len(result.Count) != n || len(result.Mean) != n || len(result.M2) != n {
+		http.Error(w, fmt.Sprintf("unit %d has a broken film", result.ID), http.StatusBadRequest)
+		return
+	}
+	if len(result.Layers) != co.layers || slices.ContainsFunc(result.Layers, func(layer []RGB) bool { return len(layer) != n }) {
+		http.Error(w, fmt.Sprintf("unit %d has broken AOVs", result.ID), http.StatusBadRequest)
+		return
+	}
+	if co.done[result.ID] {
+		// A worker thought dead came back after its unit was rendered again.
+		return
+	}
+	co.done[result.ID] = true
+	delete(co.leases, result.ID)
+	co.pending = slices.DeleteFunc(co.pending, func(id int) bool { return id == result.ID })
+
+	// Sent under the lock, so the result is waiting by the time the render looks finished.
+	// The channel has room for every unit and never blocks.
+	co.results <- result
+}
+
+func (co *Coordinator) Stop() {
+	// Stops handing out units, the render finishing with those being rendered.
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.stopped = true
+	co.pending = nil
+}
+
+func (co *Coordinator) Finished() bool {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.expire()
+	return co.finished()
+}
+
+func (co *Coordinator) finished() bool {
+	return len(co.pending) == 0 && len(co.leases) == 0
+}
+
+func (co *Coordinator) expire() {
+	// Hands out again, first, the units whose lease ran out, or drops them once stopped.
+	now := time.Now()
+	for id, end := range co.leases {
+		if now.Before(end) {
+			continue
+		}
+		delete(co.leases, id)
+		if !co.stopped {
+			log.Printf("Unit %d timed out, handing it out again", id)
+			co.pending = append([]int{id}, co.pending...)
+		}
+	}
+}
+
+func (c *Camera) Coordinate(film *Film, counts []int) bool {
+	// Renders the image with the workers joining the coordinator, merging their results into
+	// the film as they come. Every pixel gets samplesPerPixel samples, the error estimates
+	// needing the whole film to decide which pixels are done, so adaptive sampling is left to
+	// renders on a single machine. The time budget and snapshots work as they do there.
+	// Returns false if the render was interrupted by Ctrl-C.
+	units := c.WorkUnits(counts)
+	co := NewCoordinator(Job{SceneNumber, c.sceneHash}, units, len(c.aovs), LeaseDuration)
+	server := &http.Server{Addr: CoordinatorAddress, Handler: co.Handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	defer server.Close()
+	log.Printf("Waiting for workers on %s, %d units to render", CoordinatorAddress, len(units))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastSnapshot := start
+	merged := 0
+	for {
+		select {
+		case result := <-co.results:
+			film.Merge(result.Film(c.filter, c.aovs))
+			unit := units[result.ID]
+			for j := unit.Y0; j < unit.Y1; j++ {
+				for i := unit.X0; i < unit.X1; i++ {
+					first, last := unit.Samples(i, j)
+					counts[i+j*c.imageWidth] += max(last-first, 0)
+				}
+			}
+			merged++
+			log.Printf("\rUnits remaining: %d", len(units)-merged)
+		case <-ticker.C:
+			if c.timeBudget > 0 && time.Since(start) >= c.timeBudget {
+				co.Stop()
+			}
+			if c.snapshotInterval > 0 && time.Since(lastSnapshot) >= c.snapshotInterval {
+				log.Printf("Writing a snapshot after %v", time.Since(start).Round(time.Second))
+				c.Save(*film, counts)
+				lastSnapshot = time.Now()
+			}
+		case <-interrupt:
+			return false
+		}
+
+		if len(co.results) == 0 && co.Finished() {
+			// Idle workers ask for units every second, and are told the render is over
+			// before the server closes.
+			time.Sleep(2 * time.Second)
+			return true
+		}
+	}
+}
+
+func FetchJob(url string) (Job, error) {
+	// Asks the coordinator what to render, the first thing a worker does.
+	var job Job
+	hostname, _ := os.Hostname()
+	resp, err := WorkerClient.Get(fmt.Sprintf("%s/job?worker=%s-%d", url, hostname, os.Getpid()))
+	if err != nil {
+		return job, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return job, fmt.Errorf("coordinator %s answered %s", url, resp.Status)
+	}
+	err = gob.NewDecoder(resp.Body).Decode(&job)
+	return job, err
+}
+
+func (c *Camera) Work(world Hittable, lights Hittable) {
+	// Renders work units for the coordinator until the render is over, or the coordinator
+	// can't be reached for a while.
+	if hash := SceneHash(world, lights, *c); hash != WorkerJob.SceneHash {
+		log.Fatalf("Scene %d has hash %016x here and %016x on the coordinator, are they the same build?", WorkerJob.Scene, hash, WorkerJob.SceneHash)
+	}
+
+	failures := 0
+	for failures < WorkerRetries {
+		resp, err := WorkerClient.Post(CoordinatorURL+"/unit", "", nil)
+		if err != nil {
+			log.Print(err)
+			failures++
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var unit WorkUnit
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = gob.NewDecoder(resp.Body).Decode(&unit)
+		case http.StatusNoContent:
+			resp.Body.Close()
+			time.Sleep(time.Second)
+			continue
+		case http.StatusGone:
+			resp.Body.Close()
+			log.Println("Done.")
+			return
+		default:
+			err = fmt.Errorf("coordinator answered %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			log.Print(err)
+			failures++
+			time.Sleep(time.Second)
+			continue
+		}
+		failures = 0
+
+		log.Printf("Rendering unit %d, pixels (%d, %d) to (%d, %d), samples %d to %d", unit.ID, unit.X0, unit.Y0, unit.X1, unit.Y1, unit.First, unit.Last)
+		result := c.RenderUnit(unit, world, lights)
+		if err := PostResult(CoordinatorURL, result); err != nil {
+			// The unit is handed out again once its lease runs out.
+			log.Print(err)
+		}
+	}
+	log.Printf("Giving up on the coordinator at %s", CoordinatorURL)
+}
+
+func (c *Camera) RenderUnit(unit WorkUnit, world Hittable, lights Hittable) UnitResult {
+	// Renders the unit into a film covering its tile and the pixels within the radius of the
+	// filter around it, sending heartbeats all along.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				resp, err := WorkerClient.Post(fmt.Sprintf("%s/heartbeat?unit=%d", CoordinatorURL, unit.ID), "", nil)
+				if err == nil {
+					resp.Body.Close()
+				}
+			}
+		}
+	}()
+
+	margin := int(math.Ceil(c.filter.Radius()))
+	x0, y0 := max(unit.X0-margin, 0), max(unit.Y0-margin, 0)
+	x1, y1 := min(unit.X1+margin, c.imageWidth), min(unit.Y1+margin, c.imageHeight)
+	film := NewFilmRegion(x0, y0, x1-x0, y1-y0, c.filter, c.aovs)
+	for j := unit.Y0; j < unit.Y1; j++ {
+		for i := unit.X0; i < unit.X1; i++ {
+			first, last := unit.Samples(i, j)
+			for index := first; index < last; index++ {
+				c.SamplePixel(&film, i, j, index, world, lights)
+			}
+		}
+	}
+
+	return UnitResult{unit.ID, film.x0, film.y0, film.width, film.height, film.sum, film.weight, film.count, film.mean, film.m2, film.layers}
+}
+
+func PostResult(url string, result UnitResult) error {
+	// The result is encoded as it's sent, through a pipe.
+	body, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(gob.NewEncoder(writer).Encode(result))
+	}()
+	resp, err := WorkerClient.Post(url+"/result", "application/octet-stream", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator refused unit %d: %s", result.ID, resp.Status)
+	}
+	return nil
+}
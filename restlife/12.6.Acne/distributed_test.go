@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func LeaseUnit(t *testing.T, url string) (int, WorkUnit) {
+	// Asks the coordinator for a unit, like a worker, returning the status and the unit.
+	t.Helper()
+	resp, err := WorkerClient.Post(url+"/unit", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var unit WorkUnit
+	if resp.StatusCode == http.StatusOK {
+		if err := gob.NewDecoder(resp.Body).Decode(&unit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, unit
+}
+
+func TestCoordinatorReassignsExpiredUnits(t *testing.T) {
+	const lease = 100 * time.Millisecond
+	units := []WorkUnit{{0, 0, 0, 2, 2, 0, 4, make([]int, 4)}}
+	co := NewCoordinator(Job{1, 42}, units, 0, lease)
+	server := httptest.NewServer(co.Handler())
+	defer server.Close()
+
+	if status, unit := LeaseUnit(t, server.URL); status != http.StatusOK || unit.ID != 0 {
+		t.Fatalf("first request got status %d and unit %d, want %d and unit 0", status, unit.ID, http.StatusOK)
+	}
+	if status, _ := LeaseUnit(t, server.URL); status != http.StatusNoContent {
+		t.Fatalf("request while the unit is leased got status %d, want %d", status, http.StatusNoContent)
+	}
+
+	// The first worker goes quiet, and its unit is handed out again once the lease runs out.
+	time.Sleep(2 * lease)
+	if status, unit := LeaseUnit(t, server.URL); status != http.StatusOK || unit.ID != 0 {
+		t.Fatalf("request after the lease ran out got status %d and unit %d, want %d and unit 0", status, unit.ID, http.StatusOK)
+	}
+
+	result := UnitResult{0, 0, 0, 2, 2, make([]RGB, 4), make([]float64, 4), make([]int, 4), make([]float64, 4), make([]float64, 4), nil}
+	if err := PostResult(server.URL, result); err != nil {
+		t.Fatal(err)
+	}
+	// The first worker comes back late with the same unit, which is ignored.
+	if err := PostResult(server.URL, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(co.results) != 1 {
+		t.Fatalf("coordinator kept %d results of the unit, want 1", len(co.results))
+	}
+	if !co.Finished() {
+		t.Fatal("coordinator isn't finished after the only unit was rendered")
+	}
+	if status, _ := LeaseUnit(t, server.URL); status != http.StatusGone {
+		t.Fatalf("request after the render got status %d, want %d", status, http.StatusGone)
+	}
+}
+
+func TestCoordinatorRejectsBrokenResults(t *testing.T) {
+	units := []WorkUnit{{0, 0, 0, 2, 2, 0, 4, make([]int, 4)}}
+	co := NewCoordinator(Job{1, 42}, units, 1, time.Minute)
+	server := httptest.NewServer(co.Handler())
+	defer server.Close()
+
+	film := func(id, n, layers int) UnitResult {
+		result := UnitResult{id, 0, 0, 2, 2, make([]RGB, n), make([]float64, n), make([]int, n), make([]float64, n), make([]float64, n), nil}
+		for range layers {
+			result.Layers = append(result.Layers, make([]RGB, n))
+		}
+		return result
+	}
+	for _, result := range []UnitResult{film(1, 4, 1), film(-1, 4, 1), film(0, 3, 1), film(0, 4, 0)} {
+		if err := PostResult(server.URL, result); err == nil {
+			t.Errorf("coordinator took a broken result of unit %d", result.ID)
+		}
+	}
+	if len(co.results) != 0 {
+		t.Fatalf("coordinator kept %d broken results, want none", len(co.results))
+	}
+}
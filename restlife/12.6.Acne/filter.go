@@ -0,0 +1,262 @@
+package main
+
+import "math"
+
+// A PixelFilter weighs the samples around a pixel when reconstructing the image. Every sample
+// is splatted into the pixels within the radius of the filter, so neighboring pixels share
+// samples and edges are smoothed without blurring the image more than the filter does.
+type PixelFilter interface {
+	// Returns the half width of the filter, in pixels, along both axes.
+	Radius() float64
+
+	// Returns the weight of a sample at offset (x, y) from the pixel center, which can be
+	// negative for sharpening filters.
+	Evaluate(x, y float64) float64
+}
+
+type BoxFilter struct {
+	radius float64
+}
+
+func (f BoxFilter) Radius() float64 {
+	return f.radius
+}
+
+func (f BoxFilter) Evaluate(x, y float64) float64 {
+	// With a radius of half a pixel, every pixel averages its own samples.
+	if math.Abs(x) > f.radius || math.Abs(y) > f.radius {
+		return 0
+	}
+	return 1
+}
+
+type TentFilter struct {
+	radius float64
+}
+
+func (f TentFilter) Radius() float64 {
+	return f.radius
+}
+
+func (f TentFilter) Evaluate(x, y float64) float64 {
+	return math.Max(0, f.radius-math.Abs(x)) * math.Max(0, f.radius-math.Abs(y))
+}
+
+type GaussianFilter struct {
+	radius float64
+	sigma  float64 // Standard deviation, in pixels
+}
+
+func (f GaussianFilter) Radius() float64 {
+	return f.radius
+}
+
+func (f GaussianFilter) Evaluate(x, y float64) float64 {
+	return f.Gaussian(x) * f.Gaussian(y)
+}
+
+func (f GaussianFilter) Gaussian(x float64) float64 {
+	// The value at the radius is subtracted so the filter falls to zero there instead of
+	// being cut off.
+	g := func(d float64) float64 {
+		return math.Exp(-d * d / (2 * f.sigma * f.sigma))
+	}
+	return math.Max(0, g(x)-g(f.radius))
+}
+
+type MitchellFilter struct {
+	radius float64
+	b, c   float64 // Blur and ringing parameters, 1/3 and 1/3 being the recommended balance
+}
+
+func NewMitchellFilter(radius float64) MitchellFilter {
+	return MitchellFilter{radius, 1.0 / 3, 1.0 / 3}
+}
+
+func (f MitchellFilter) Radius() float64 {
+	return f.radius
+}
+
+func (f MitchellFilter) Evaluate(x, y float64) float64 {
+	// The cubic spans [-2, 2], stretched over the radius.
+	return f.Mitchell(2*x/f.radius) * f.Mitchell(2*y/f.radius)
+}
+
+func (f MitchellFilter) Mitchell(x float64) float64 {
+	// Piecewise cubic of Mitchell and Netravali, with negative lobes between 1 and 2 that
+	// sharpen the image.
+	x = math.Abs(x)
+	b, c := f.b, f.c
+	switch {
+	case x < 1:
+		return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+	case x < 2:
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+	default:
+		return 0
+	}
+}
+
+type BlackmanHarrisFilter struct {
+	radius float64
+}
+
+func (f BlackmanHarrisFilter) Radius() float64 {
+	return f.radius
+}
+
+func (f BlackmanHarrisFilter) Evaluate(x, y float64) float64 {
+	return f.BlackmanHarris(x) * f.BlackmanHarris(y)
+}
+
+func (f BlackmanHarrisFilter) BlackmanHarris(x float64) float64 {
+	// Four term Blackman-Harris window over [-radius, radius], close to a Gaussian with
+	// very low side lobes.
+	if math.Abs(x) >= f.radius {
+		return 0
+	}
+	t := math.Pi * (x/f.radius + 1)
+	return 0.35875 - 0.48829*math.Cos(t) + 0.14128*math.Cos(2*t) - 0.01168*math.Cos(3*t)
+}
+
+// The Film accumulates the filtered samples of every pixel along with the sum of their
+// weights, the pixel color being their ratio. It also keeps the running mean and variance of
+// the brightness of the samples taken in every pixel, to estimate their error. A film can
+// cover only a region of the image, from pixel (x0, y0), pixels being addressed in image
+// coordinates either way. The sums of the AOVs of the samples are kept in layers, one for
+// every AOV, weighted like the image.
+type Film struct {
+	x0, y0        int
+	width, height int
+	filter        PixelFilter
+	sum           []RGB
+	weight        []float64
+	count         []int
+	mean          []float64
+	m2            []float64 // Sum of the squared differences to the mean
+	aovs          []AOV
+	layers        [][]RGB
+}
+
+func NewFilm(width, height int, filter PixelFilter, aovs []AOV) Film {
+	return NewFilmRegion(0, 0, width, height, filter, aovs)
+}
+
+func NewFilmRegion(x0, y0, width, height int, filter PixelFilter, aovs []AOV) Film {
+	n := width * height
+	layers := make([][]RGB, len(aovs))
+	for l := range layers {
+		layers[l] = make([]RGB, n)
+	}
+	return Film{x0, y0, width, height, filter, make([]RGB, n), make([]float64, n), make([]int, n), make([]float64, n), make([]float64, n), aovs, layers}
+}
+
+func (f *Film) AddSample(x, y float64, sample RGB, values []RGB, region [4]int) {
+	// Splats a sample taken at (x, y), in pixels from the upper left corner of the image,
+	// into every pixel whose center is within the radius of the filter, along with the values
+	// of its AOVs, if the film has any. Only pixels of the region, given as x0, y0, x1, y1
+	// with x1 and y1 excluded, take the sample, so the views of a stereo pair don't bleed
+	// into each other.
+	f.AddStatistics(min(int(x), f.x0+f.width-1), min(int(y), f.y0+f.height-1), sample.Average())
+
+	radius := f.filter.Radius()
+	i0 := max(int(math.Ceil(x-0.5-radius)), f.x0, region[0])
+	i1 := min(int(math.Floor(x-0.5+radius)), f.x0+f.width-1, region[2]-1)
+	j0 := max(int(math.Ceil(y-0.5-radius)), f.y0, region[1])
+	j1 := min(int(math.Floor(y-0.5+radius)), f.y0+f.height-1, region[3]-1)
+	for j := j0; j <= j1; j++ {
+		for i := i0; i <= i1; i++ {
+			w := f.filter.Evaluate(x-float64(i)-0.5, y-float64(j)-0.5)
+			if w == 0 {
+				continue
+			}
+			k := f.Index(i, j)
+			f.sum[k] = f.sum[k].Add(sample.Muln(w))
+			f.weight[k] += w
+			for l, value := range values {
+				f.layers[l][k] = f.layers[l][k].Add(value.Muln(w))
+			}
+		}
+	}
+}
+
+func (f Film) Index(i, j int) int {
+	return i - f.x0 + (j-f.y0)*f.width
+}
+
+func (f Film) Pixel(i, j int) RGB {
+	// Pixels without any weight, which narrow filters can leave, stay black.
+	k := f.Index(i, j)
+	if f.weight[k] <= 0 {
+		return RGB{0, 0, 0}
+	}
+	return f.sum[k].Divn(f.weight[k])
+}
+
+func (f Film) Layer(l, i, j int) RGB {
+	// Returns the value of the AOV of the film's layer l in the pixel.
+	k := f.Index(i, j)
+	if f.weight[k] <= 0 {
+		return RGB{0, 0, 0}
+	}
+	return f.layers[l][k].Divn(f.weight[k])
+}
+
+func (f *Film) AddStatistics(i, j int, value float64) {
+	// Welford's online update of the mean and variance of the pixel's samples.
+	k := f.Index(i, j)
+	f.count[k]++
+	delta := value - f.mean[k]
+	f.mean[k] += delta / float64(f.count[k])
+	f.m2[k] += delta * (value - f.mean[k])
+}
+
+func (f Film) Variance(i, j int) float64 {
+	// Returns the variance of the mean of the brightness of the pixel's samples, 0 while it
+	// can't be estimated yet.
+	k := f.Index(i, j)
+	n := float64(f.count[k])
+	if n < 2 {
+		return 0
+	}
+	return f.m2[k] / (n - 1) / n
+}
+
+func (f Film) Error(i, j int) float64 {
+	// Returns the estimated error of the pixel, as the standard error of the mean of its
+	// samples, carried through the gamma of the image so dark pixels need as much care as
+	// bright ones.
+	k := f.Index(i, j)
+	n := float64(f.count[k])
+	if n < 2 {
+		return math.Inf(1)
+	}
+	standardError := math.Sqrt(f.m2[k] / (n - 1) / n)
+	return standardError / (2 * math.Sqrt(math.Max(f.mean[k], 1e-4)))
+}
+
+func (f *Film) Merge(other Film) {
+	// Adds the samples of another film, of the same image, where the films overlap. Their
+	// statistics are combined with Chan's parallel update, as if all the samples had been
+	// added to this film.
+	for j := max(f.y0, other.y0); j < min(f.y0+f.height, other.y0+other.height); j++ {
+		for i := max(f.x0, other.x0); i < min(f.x0+f.width, other.x0+other.width); i++ {
+			k, l := f.Index(i, j), other.Index(i, j)
+			f.sum[k] = f.sum[k].Add(other.sum[l])
+			f.weight[k] += other.weight[l]
+			for layer := range f.layers {
+				f.layers[layer][k] = f.layers[layer][k].Add(other.layers[layer][l])
+			}
+
+			n := f.count[k] + other.count[l]
+			if n == 0 {
+				continue
+			}
+			delta := other.mean[l] - f.mean[k]
+			ratio := float64(other.count[l]) / float64(n)
+			f.mean[k] += delta * ratio
+			f.m2[k] += other.m2[l] + delta*delta*float64(f.count[k])*ratio
+			f.count[k] = n
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import "math"
+
+// Number of cells along each side of the blocks whose height range is kept for skipping.
+const HeightfieldBlockSize = 16
+
+type Heightfield struct {
+	heights      []float32 // nx by nz samples, row by row along x
+	nx, nz       int
+	corner       Point3 // Position of the first sample at height zero
+	size         Vec3   // Extent along x and z, and the height of a sample of one
+	mat          Material
+	bbox         AABB
+	blockMin     []float32 // Lowest and highest sample of each block of cells
+	blockMax     []float32
+	blocksX      int
+	blocksZ      int
+	cellW, cellD float64
+}
+
+func NewHeightfield(heights []float32, nx, nz int, corner Point3, size Vec3, mat Material) Heightfield {
+	// The samples sit on a regular grid over the x and z extent of size, every cell between
+	// four samples split into two triangles.
+	hit := Heightfield{heights: heights, nx: nx, nz: nz, corner: corner, size: size, mat: mat}
+	hit.cellW = size.X() / float64(nx-1)
+	hit.cellD = size.Z() / float64(nz-1)
+
+	// Keep the height range of every block, so rays passing above or below skip it whole.
+	hit.blocksX = (nx - 2 + HeightfieldBlockSize) / HeightfieldBlockSize
+	hit.blocksZ = (nz - 2 + HeightfieldBlockSize) / HeightfieldBlockSize
+	hit.blockMin = make([]float32, hit.blocksX*hit.blocksZ)
+	hit.blockMax = make([]float32, hit.blocksX*hit.blocksZ)
+	for b := range hit.blockMin {
+		hit.blockMin[b] = float32(math.Inf(1))
+		hit.blockMax[b] = float32(math.Inf(-1))
+	}
+	for j := range nz {
+		for i := range nx {
+			h := heights[j*nx+i]
+			// Samples on block borders belong to the cells on both sides.
+			bj0, bj1 := HeightfieldBlocks(j, nz)
+			bi0, bi1 := HeightfieldBlocks(i, nx)
+			for bj := bj0; bj <= bj1; bj++ {
+				for bi := bi0; bi <= bi1; bi++ {
+					b := bj*hit.blocksX + bi
+					hit.blockMin[b] = min(hit.blockMin[b], h)
+					hit.blockMax[b] = max(hit.blockMax[b], h)
+				}
+			}
+		}
+	}
+
+	low, high := float32(math.Inf(1)), float32(math.Inf(-1))
+	for b := range hit.blockMin {
+		low, high = min(low, hit.blockMin[b]), max(high, hit.blockMax[b])
+	}
+	bottom := corner.Add(Vec3{0, float64(low) * size.Y(), 0})
+	top := corner.Add(Vec3{size.X(), float64(high) * size.Y(), size.Z()})
+	hit.bbox = NewAABBPoint(bottom, top)
+	return hit
+}
+
+func NewHeightfieldImage(image RTWImage, corner Point3, size Vec3, mat Material) Heightfield {
+	// One sample per pixel, the height being the average of its channels. Load height maps
+	// with ColorRaw so they aren't linearized.
+	heights := make([]float32, image.width*image.height)
+	for j := range image.height {
+		for i := range image.width {
+			heights[j*image.width+i] = float32(image.Get(i, image.height-1-j).Average())
+		}
+	}
+	return NewHeightfield(heights, image.width, image.height, corner, size, mat)
+}
+
+func NewHeightfieldTexture(tex Texture, nx, nz int, corner Point3, size Vec3, mat Material) Heightfield {
+	// Samples the average of the texture on the base of the heightfield, with UVs running
+	// from 0 to 1 along x and z.
+	heights := make([]float32, nx*nz)
+	for j := range nz {
+		for i := range nx {
+			u, v := float64(i)/float64(nx-1), float64(j)/float64(nz-1)
+			p := corner.Add(Vec3{u * size.X(), 0, v * size.Z()})
+			heights[j*nx+i] = float32(tex.Value(u, v, p).Average())
+		}
+	}
+	return NewHeightfield(heights, nx, nz, corner, size, mat)
+}
+
+func HeightfieldBlocks(i, n int) (int, int) {
+	// Returns the range of blocks touching sample i along an axis with n samples. A sample is
+	// a corner of the cells on both sides of it.
+	last := (n - 2) / HeightfieldBlockSize
+	return min(max(i-1, 0)/HeightfieldBlockSize, last), min(i/HeightfieldBlockSize, last)
+}
+
+func (hit Heightfield) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	ok, clipped := hit.bbox.Clip(r, intvl)
+	if !ok {
+		return false, HitRecord{}
+	}
+
+	// Walk the blocks under the ray front to back, then the cells of the blocks whose height
+	// range the ray crosses, so the first triangle hit is the closest.
+	ox, oz := (r.orig.X()-hit.corner.X())/hit.cellW, (r.orig.Z()-hit.corner.Z())/hit.cellD
+	dx, dz := r.dir.X()/hit.cellW, r.dir.Z()/hit.cellD
+	cellsX, cellsZ := hit.nx-1, hit.nz-1
+	block := float64(HeightfieldBlockSize)
+
+	found := false
+	rec := HitRecord{}
+	GridTraverse(ox/block, oz/block, dx/block, dz/block, clipped, hit.blocksX, hit.blocksZ, func(bi, bj int, span Interval) bool {
+		b := bj*hit.blocksX + bi
+		if !hit.Overlaps(r, span, hit.blockMin[b], hit.blockMax[b]) {
+			return false
+		}
+		GridTraverse(ox, oz, dx, dz, span, cellsX, cellsZ, func(i, j int, cellSpan Interval) bool {
+			found, rec = hit.HitCell(r, Interval{clipped.min, clipped.max}, i, j)
+			return found
+		})
+		return found
+	})
+	return found, rec
+}
+
+func (hit Heightfield) Overlaps(r Ray, span Interval, low, high float32) bool {
+	// Reports whether the ray passes through the height range over the span of t.
+	y0, y1 := r.At(span.min).Y(), r.At(span.max).Y()
+	bottom := hit.corner.Y() + float64(low)*hit.size.Y()
+	top := hit.corner.Y() + float64(high)*hit.size.Y()
+	return max(y0, y1) >= bottom-1e-6 && min(y0, y1) <= top+1e-6
+}
+
+func GridTraverse(ox, oz, dx, dz float64, span Interval, nx, nz int, visit func(i, j int, span Interval) bool) {
+	// Visits the cells of an nx by nz grid with unit cells that the ray from (ox, oz) along
+	// (dx, dz) crosses during span, in order, until visit returns true. This is the 2D DDA
+	// of Amanatides and Woo.
+	t := span.min
+	i := Clamp(int(math.Floor(ox+dx*t)), 0, nx-1)
+	j := Clamp(int(math.Floor(oz+dz*t)), 0, nz-1)
+
+	stepI, nextI, deltaI := GridAxis(ox, dx, i)
+	stepJ, nextJ, deltaJ := GridAxis(oz, dz, j)
+
+	for t < span.max {
+		exit := min(nextI, nextJ, span.max)
+		if visit(i, j, Interval{t, exit}) {
+			return
+		}
+		t = exit
+		if nextI < nextJ {
+			i += stepI
+			nextI += deltaI
+		} else {
+			j += stepJ
+			nextJ += deltaJ
+		}
+		if i < 0 || i >= nx || j < 0 || j >= nz {
+			return
+		}
+	}
+}
+
+func GridAxis(o, d float64, cell int) (int, float64, float64) {
+	// Returns the cell step along one axis, the t of the next cell boundary and the t between
+	// boundaries.
+	switch {
+	case d > 0:
+		return 1, (float64(cell+1) - o) / d, 1 / d
+	case d < 0:
+		return -1, (float64(cell) - o) / d, -1 / d
+	default:
+		return 0, math.Inf(1), math.Inf(1)
+	}
+}
+
+func (hit Heightfield) HitCell(r Ray, intvl Interval, i, j int) (bool, HitRecord) {
+	// Intersects the two triangles of cell (i, j), keeping the closest hit.
+	found := false
+	closest := HitRecord{}
+	corners := [4][2]int{{i, j}, {i + 1, j}, {i + 1, j + 1}, {i, j + 1}}
+	for _, tri := range [2][3]int{{0, 1, 2}, {0, 2, 3}} {
+		a, b, c := corners[tri[0]], corners[tri[1]], corners[tri[2]]
+		p0, p1, p2 := hit.Point(a[0], a[1]), hit.Point(b[0], b[1]), hit.Point(c[0], c[1])
+		ok, t, b1, b2 := IntersectTriangle(r, p0, p1, p2, intvl)
+		if !ok {
+			continue
+		}
+
+		b0 := 1 - b1 - b2
+		rec := HitRecord{}
+		rec.t = t
+		rec.p = r.At(t)
+		rec.u = (rec.p.X() - hit.corner.X()) / hit.size.X()
+		rec.v = (rec.p.Z() - hit.corner.Z()) / hit.size.Z()
+		rec.mat = hit.mat
+
+		outwardNormal := p1.Sub(p0).Cross(p2.Sub(p0)).Normalize()
+		if outwardNormal.Y() < 0 {
+			outwardNormal = outwardNormal.Muln(-1)
+		}
+		rec.SetFaceNormal(r, outwardNormal)
+		rec.objectP, rec.objectNormal = rec.p, outwardNormal
+		rec.dpdu = Vec3{hit.size.X(), 0, 0}
+		rec.dpdv = Vec3{0, 0, hit.size.Z()}
+
+		// Shade with the normals at the samples, interpolated across the triangle.
+		shading := hit.Normal(a[0], a[1]).Muln(b0).Add(hit.Normal(b[0], b[1]).Muln(b1)).Add(hit.Normal(c[0], c[1]).Muln(b2)).Normalize()
+		if shading.Dot(rec.geomNormal) < 0 {
+			shading = shading.Muln(-1)
+		}
+		rec.normal = shading
+
+		found, closest = true, rec
+		intvl.max = t
+	}
+	return found, closest
+}
+
+func (hit Heightfield) Height(i, j int) float64 {
+	i, j = Clamp(i, 0, hit.nx-1), Clamp(j, 0, hit.nz-1)
+	return float64(hit.heights[j*hit.nx+i]) * hit.size.Y()
+}
+
+func (hit Heightfield) Point(i, j int) Point3 {
+	return hit.corner.Add(Vec3{float64(i) * hit.cellW, hit.Height(i, j), float64(j) * hit.cellD})
+}
+
+func (hit Heightfield) Normal(i, j int) Vec3 {
+	// Normal at a sample from the central differences of the heights around it.
+	dhdx := (hit.Height(i+1, j) - hit.Height(i-1, j)) / (float64(min(i+1, hit.nx-1)-max(i-1, 0)) * hit.cellW)
+	dhdz := (hit.Height(i, j+1) - hit.Height(i, j-1)) / (float64(min(j+1, hit.nz-1)-max(j-1, 0)) * hit.cellD)
+	return Vec3{-dhdx, 1, -dhdz}.Normalize()
+}
+
+func (hit Heightfield) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Heightfield) PDFValue(origin Point3, direction Vec3) float64 {
+	return 0
+}
+
+func (hit Heightfield) Random(origin Point3, s Sampler) Vec3 {
+	return Vec3{1, 0, 0}
+}
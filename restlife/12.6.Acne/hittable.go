@@ -10,17 +10,27 @@ type Hittable interface {
 	Hit(r Ray, intvl Interval) (bool, HitRecord)
 	BoundingBox() AABB
 	PDFValue(origin Point3, direction Vec3) float64
-	Random(origin Point3) Vec3
+	Random(origin Point3, s Sampler) Vec3
 }
 
 type HitRecord struct {
-	p         Point3
-	normal    Vec3
-	mat       Material
-	t         float64
-	u         float64
-	v         float64
-	frontFace bool
+	p          Point3
+	normal     Vec3 // Shading normal, may be perturbed by materials
+	geomNormal Vec3 // Geometric normal of the surface, on the same side as normal
+	dpdu       Vec3 // Partial derivative of p with respect to u (tangent)
+	dpdv       Vec3 // Partial derivative of p with respect to v (bitangent)
+	mat        Material
+	t          float64
+	u          float64
+	v          float64
+	frontFace  bool
+	footprint  float64 // Width of the ray cone at p, or 0 when unknown
+	tm         float64 // Time of the ray that hit
+
+	// Hit point and outward normal in the frame of the primitive, before any Translate or
+	// RotateY moved it into the world.
+	objectP      Point3
+	objectNormal Vec3
 }
 
 func (hit *HitRecord) SetFaceNormal(r Ray, outwardNormal Vec3) {
@@ -32,6 +42,7 @@ func (hit *HitRecord) SetFaceNormal(r Ray, outwardNormal Vec3) {
 	} else {
 		hit.normal = outwardNormal.Muln(-1)
 	}
+	hit.geomNormal = hit.normal
 }
 
 type HittableList struct {
@@ -74,9 +85,24 @@ func (hit HittableList) PDFValue(origin Point3, direction Vec3) float64 {
 	return sum
 }
 
-func (hit HittableList) Random(origin Point3) Vec3 {
-	intSize := len(hit.objects)
-	return hit.objects[int(RandomRange(0, float64(intSize-1)))].Random(origin)
+func (hit HittableList) Random(origin Point3, s Sampler) Vec3 {
+	n := len(hit.objects)
+	return hit.objects[min(int(s.Get1D()*float64(n)), n-1)].Random(origin, s)
+}
+
+func HitAll(object Hittable, r Ray, intvl Interval) []HitRecord {
+	// Returns every intersection of the ray with the object within the interval, in order, by
+	// searching again just past each hit. Only meaningful for objects whose Hit is
+	// deterministic, unlike ConstantMedium.
+	var recs []HitRecord
+	for {
+		hitAnything, rec := object.Hit(r, intvl)
+		if !hitAnything {
+			return recs
+		}
+		recs = append(recs, rec)
+		intvl = Interval{math.Nextafter(rec.t, math.MaxFloat64), intvl.max}
+	}
 }
 
 type Sphere struct {
@@ -130,7 +156,9 @@ func (hit Sphere) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	rec.p = r.At(rec.t)
 	outwardNormal := rec.p.Sub(currentCenter).Divn(hit.radius)
 	rec.SetFaceNormal(r, outwardNormal)
+	rec.objectP, rec.objectNormal = rec.p, outwardNormal
 	rec.u, rec.v = GetSphereUV(outwardNormal)
+	rec.dpdu, rec.dpdv = GetSphereTangents(outwardNormal, hit.radius)
 	rec.mat = hit.mat
 
 	return true, rec
@@ -156,11 +184,12 @@ func (hit Sphere) PDFValue(origin Point3, direction Vec3) float64 {
 	return 1 / solidAngle
 }
 
-func (hit Sphere) Random(origin Point3) Vec3 {
+func (hit Sphere) Random(origin Point3, s Sampler) Vec3 {
 	direction := hit.center.At(0).Sub(origin)
 	distanceSquared := direction.Dot(direction)
 	uvw := NewONB(direction)
-	return uvw.Transform(RandomToSphere(hit.radius, distanceSquared))
+	r1, r2 := s.Get2D()
+	return uvw.Transform(SampleToSphere(hit.radius, distanceSquared, r1, r2))
 }
 
 func GetSphereUV(p Point3) (float64, float64) {
@@ -179,6 +208,45 @@ func GetSphereUV(p Point3) (float64, float64) {
 	return u, v
 }
 
+func GetSphereTangents(p Point3, radius float64) (Vec3, Vec3) {
+	// p: a given point on the sphere of radius one, centered at the origin.
+	// Returns the derivatives of the surface point with respect to the u and v of GetSphereUV.
+
+	sinTheta := math.Sqrt(math.Max(0, 1-p.Y()*p.Y()))
+	if sinTheta < 1e-8 {
+		// At the poles u is degenerate, so pick any frame around the normal.
+		uvw := NewONB(p)
+		return uvw.U().Muln(2 * math.Pi * radius), uvw.V().Muln(math.Pi * radius)
+	}
+
+	dpdu := Vec3{p.Z(), 0, -p.X()}.Muln(2 * math.Pi * radius)
+	dpdv := Vec3{-p.X() * p.Y() / sinTheta, sinTheta, -p.Y() * p.Z() / sinTheta}.Muln(math.Pi * radius)
+
+	return dpdu, dpdv
+}
+
+func GetTriangleTangents(p0, p1, p2 Point3, uv0, uv1, uv2 [2]float64) (Vec3, Vec3) {
+	// Returns the derivatives of the surface point with respect to u and v over a triangle
+	// with the given vertex positions and texture coordinates.
+
+	e1, e2 := p1.Sub(p0), p2.Sub(p0)
+	du1, dv1 := uv1[0]-uv0[0], uv1[1]-uv0[1]
+	du2, dv2 := uv2[0]-uv0[0], uv2[1]-uv0[1]
+
+	determinant := du1*dv2 - dv1*du2
+	if math.Abs(determinant) < 1e-12 {
+		// Degenerate texture coordinates, fall back to a frame built from the face normal.
+		uvw := NewONB(e1.Cross(e2))
+		return uvw.U(), uvw.V()
+	}
+
+	invDet := 1 / determinant
+	dpdu := e1.Muln(dv2).Sub(e2.Muln(dv1)).Muln(invDet)
+	dpdv := e2.Muln(du1).Sub(e1.Muln(du2)).Muln(invDet)
+
+	return dpdu, dpdv
+}
+
 type BVHNode struct {
 	left  Hittable
 	right Hittable
@@ -249,7 +317,7 @@ func (hit BVHNode) PDFValue(origin Point3, direction Vec3) float64 {
 	return 0
 }
 
-func (hit BVHNode) Random(origin Point3) Vec3 {
+func (hit BVHNode) Random(origin Point3, s Sampler) Vec3 {
 	return Vec3{1, 0, 0}
 }
 
@@ -271,7 +339,15 @@ func BoxZCompare(a, b Hittable) bool {
 	return BoxCompare(a, b, 2)
 }
 
-type Quad struct {
+type PlanarShape int
+
+const (
+	ShapeQuad     PlanarShape = iota // Parallelogram spanned by u and v from the corner q
+	ShapeTriangle                    // Triangle with vertices q, q+u and q+v
+	ShapeEllipse                     // Ellipse centered on q with semi-axes u and v
+)
+
+type Planar struct {
 	q      Point3
 	u, v   Vec3
 	w      Vec3
@@ -280,27 +356,65 @@ type Quad struct {
 	normal Vec3
 	d      float64
 	area   float64
+	shape  PlanarShape
 }
 
-func NewQuad(q Point3, u, v Vec3, mat Material) Quad {
+type Quad = Planar
+
+func NewPlanar(q Point3, u, v Vec3, mat Material, shape PlanarShape) Planar {
 	n := u.Cross(v)
 	normal := n.Normalize()
 	d := normal.Dot(q)
 	w := n.Divn(n.Dot(n))
 	area := n.Length()
-	quad := Quad{q: q, u: u, v: v, w: w, mat: mat, normal: normal, d: d, area: area}
-	quad.SetBoundingBox()
-	return quad
+	switch shape {
+	case ShapeTriangle:
+		area /= 2
+	case ShapeEllipse:
+		area *= math.Pi
+	}
+	planar := Planar{q: q, u: u, v: v, w: w, mat: mat, normal: normal, d: d, area: area, shape: shape}
+	planar.SetBoundingBox()
+	return planar
+}
+
+func NewQuad(q Point3, u, v Vec3, mat Material) Quad {
+	return NewPlanar(q, u, v, mat, ShapeQuad)
+}
+
+func NewTriangle(a, b, c Point3, mat Material) Planar {
+	return NewPlanar(a, b.Sub(a), c.Sub(a), mat, ShapeTriangle)
+}
+
+func NewEllipse(center Point3, u, v Vec3, mat Material) Planar {
+	return NewPlanar(center, u, v, mat, ShapeEllipse)
 }
 
-func (hit *Quad) SetBoundingBox() {
-	// Compute the bounding box of all four vertices.
-	bboxDiagonal1 := NewAABBPoint(hit.q, hit.q.Add(hit.u).Add(hit.v))
-	bboxDiagonal2 := NewAABBPoint(hit.q.Add(hit.u), hit.q.Add(hit.v))
-	hit.bbox = NewAABBBox(bboxDiagonal1, bboxDiagonal2)
+func NewDisk(center Point3, normal Vec3, radius float64, mat Material) Planar {
+	uvw := NewONB(normal)
+	return NewPlanar(center, uvw.U().Muln(radius), uvw.V().Muln(radius), mat, ShapeEllipse)
 }
 
-func (hit Quad) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+func (hit *Planar) SetBoundingBox() {
+	switch hit.shape {
+	case ShapeTriangle:
+		// Compute the bounding box of the three vertices.
+		hit.bbox = NewAABBBox(NewAABBPoint(hit.q, hit.q.Add(hit.u)), NewAABBPoint(hit.q, hit.q.Add(hit.v)))
+	case ShapeEllipse:
+		// Compute the bounding box of the parallelogram enclosing the ellipse.
+		corner := hit.q.Sub(hit.u).Sub(hit.v)
+		bboxDiagonal1 := NewAABBPoint(corner, hit.q.Add(hit.u).Add(hit.v))
+		bboxDiagonal2 := NewAABBPoint(hit.q.Add(hit.u).Sub(hit.v), hit.q.Sub(hit.u).Add(hit.v))
+		hit.bbox = NewAABBBox(bboxDiagonal1, bboxDiagonal2)
+	default:
+		// Compute the bounding box of all four vertices.
+		bboxDiagonal1 := NewAABBPoint(hit.q, hit.q.Add(hit.u).Add(hit.v))
+		bboxDiagonal2 := NewAABBPoint(hit.q.Add(hit.u), hit.q.Add(hit.v))
+		hit.bbox = NewAABBBox(bboxDiagonal1, bboxDiagonal2)
+	}
+}
+
+func (hit Planar) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	denom := hit.normal.Dot(r.dir)
 
 	// No hit if the ray is parallel to the plane.
@@ -320,7 +434,7 @@ func (hit Quad) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	alpha := hit.w.Dot(planarHitptVector.Cross(hit.v))
 	beta := hit.w.Dot(hit.u.Cross(planarHitptVector))
 
-	ok, rec := IsInterior(alpha, beta)
+	ok, rec := hit.IsInterior(alpha, beta)
 	if !ok {
 		return false, rec
 	}
@@ -330,31 +444,68 @@ func (hit Quad) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	rec.p = intersection
 	rec.mat = hit.mat
 	rec.SetFaceNormal(r, hit.normal)
+	rec.objectP, rec.objectNormal = rec.p, hit.normal
 
 	return true, rec
 }
 
-func (hit Quad) BoundingBox() AABB {
-	return hit.bbox
-}
-
-func (hit Quad) PDFValue(origin Point3, direction Vec3) float64 {
-	hitAnything, rec := hit.Hit(Ray{origin, direction, 0}, Interval{0.001, math.MaxFloat64})
-	if !hitAnything {
-		return 0
+func (hit Planar) IsInterior(a, b float64) (bool, HitRecord) {
+	// Dispatches the interior test on the shape, and sets the tangents matching its UVs.
+	var ok bool
+	var rec HitRecord
+	switch hit.shape {
+	case ShapeTriangle:
+		ok, rec = IsInteriorTriangle(a, b)
+		rec.dpdu, rec.dpdv = hit.u, hit.v
+	case ShapeEllipse:
+		ok, rec = IsInteriorEllipse(a, b)
+		rec.dpdu, rec.dpdv = hit.u.Muln(2), hit.v.Muln(2)
+	default:
+		ok, rec = IsInterior(a, b)
+		rec.dpdu, rec.dpdv = hit.u, hit.v
 	}
+	return ok, rec
+}
 
-	distanceSquared := rec.t * rec.t * direction.Dot(direction)
-	cosine := math.Abs(direction.Dot(rec.normal) / direction.Length())
+func (hit Planar) BoundingBox() AABB {
+	return hit.bbox
+}
 
-	return distanceSquared / (cosine * hit.area)
+func (hit Planar) PDFValue(origin Point3, direction Vec3) float64 {
+	return AreaPDFValue(hit, hit.area, origin, direction)
 }
 
-func (hit Quad) Random(origin Point3) Vec3 {
-	p := hit.q.Add(hit.u.Muln(rand.Float64())).Add(hit.v.Muln(rand.Float64()))
+func (hit Planar) Random(origin Point3, s Sampler) Vec3 {
+	var p Point3
+	a, b := s.Get2D()
+	switch hit.shape {
+	case ShapeTriangle:
+		if a+b > 1 {
+			a, b = 1-a, 1-b
+		}
+		p = hit.q.Add(hit.u.Muln(a)).Add(hit.v.Muln(b))
+	case ShapeEllipse:
+		d := SampleUnitDisk(a, b)
+		p = hit.q.Add(hit.u.Muln(d[0])).Add(hit.v.Muln(d[1]))
+	default:
+		p = hit.q.Add(hit.u.Muln(a)).Add(hit.v.Muln(b))
+	}
 	return p.Sub(origin)
 }
 
+func AreaPDFValue(object Hittable, area float64, origin Point3, direction Vec3) float64 {
+	// Converts the uniform area density of a light surface into a solid angle density for the
+	// direction from origin. Curved surfaces can be crossed several times along the direction,
+	// and every crossing could have been sampled, so their densities add up.
+	sum := 0.0
+	for _, rec := range HitAll(object, Ray{origin, direction, 0}, Interval{0.001, math.MaxFloat64}) {
+		distanceSquared := rec.t * rec.t * direction.Dot(direction)
+		cosine := math.Abs(direction.Dot(rec.normal) / direction.Length())
+		sum += distanceSquared / (cosine * area)
+	}
+	return sum
+}
+
 func IsInterior(a, b float64) (bool, HitRecord) {
 	unitInterval := Interval{0, 1}
 	// Given the hit point in plane coordinates, return false if it is outside the
@@ -370,6 +521,29 @@ func IsInterior(a, b float64) (bool, HitRecord) {
 	return true, rec
 }
 
+func IsInteriorTriangle(a, b float64) (bool, HitRecord) {
+	if a < 0 || b < 0 || a+b > 1 {
+		return false, HitRecord{}
+	}
+
+	rec := HitRecord{}
+	rec.u = a
+	rec.v = b
+	return true, rec
+}
+
+func IsInteriorEllipse(a, b float64) (bool, HitRecord) {
+	// The plane coordinates are relative to the center, scaled so the boundary is the unit circle.
+	if a*a+b*b > 1 {
+		return false, HitRecord{}
+	}
+
+	rec := HitRecord{}
+	rec.u = a/2 + 0.5
+	rec.v = b/2 + 0.5
+	return true, rec
+}
+
 func Box(a, b Point3, mat Material) HittableList {
 	// Returns the 3D box (six sides) that contains the two opposite vertices a & b.
 	sides := HittableList{}
@@ -427,7 +601,7 @@ func (hit Translate) PDFValue(origin Point3, direction Vec3) float64 {
 	return 0
 }
 
-func (hit Translate) Random(origin Point3) Vec3 {
+func (hit Translate) Random(origin Point3, s Sampler) Vec3 {
 	return Vec3{1, 0, 0}
 }
 
@@ -491,17 +665,22 @@ func (hit RotateY) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	}
 
 	// Transform the intersection from object space back to world space.
-	rec.p = Point3{hit.cosTheta*rec.p.X() + hit.sinTheta*rec.p.Z(),
-		rec.p.Y(),
-		-hit.sinTheta*rec.p.X() + hit.cosTheta*rec.p.Z()}
-
-	rec.normal = Vec3{hit.cosTheta*rec.normal.X() + hit.sinTheta*rec.normal.Z(),
-		rec.normal.Y(),
-		-hit.sinTheta*rec.normal.X() + hit.cosTheta*rec.normal.Z()}
+	rec.p = hit.ToWorld(rec.p)
+	rec.normal = hit.ToWorld(rec.normal)
+	rec.geomNormal = hit.ToWorld(rec.geomNormal)
+	rec.dpdu = hit.ToWorld(rec.dpdu)
+	rec.dpdv = hit.ToWorld(rec.dpdv)
 
 	return true, rec
 }
 
+func (hit RotateY) ToWorld(v Vec3) Vec3 {
+	// Rotates an object space point or direction back into world space.
+	return Vec3{hit.cosTheta*v.X() + hit.sinTheta*v.Z(),
+		v.Y(),
+		-hit.sinTheta*v.X() + hit.cosTheta*v.Z()}
+}
+
 func (hit RotateY) BoundingBox() AABB {
 	return hit.bbox
 }
@@ -510,10 +689,60 @@ func (hit RotateY) PDFValue(origin Point3, direction Vec3) float64 {
 	return 0
 }
 
-func (hit RotateY) Random(origin Point3) Vec3 {
+func (hit RotateY) Random(origin Point3, s Sampler) Vec3 {
 	return Vec3{1, 0, 0}
 }
 
+type Cutout struct {
+	object    Hittable
+	opacity   Texture
+	threshold float64
+}
+
+func NewCutout(object Hittable, opacity Texture, threshold float64) Cutout {
+	// Makes parts of the object transparent where the opacity texture is low. Hits are kept if
+	// the opacity reaches the threshold, or with a probability equal to the opacity when the
+	// threshold is zero, which gives soft edges once the pixel samples are averaged.
+	return Cutout{object, opacity, threshold}
+}
+
+func (hit Cutout) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	// Skip over transparent hits and keep searching further along the ray, so objects behind
+	// the cutout are found by the BVH and the rays sampled towards lights alike.
+	for {
+		hitAnything, rec := hit.object.Hit(r, intvl)
+		if !hitAnything {
+			return false, HitRecord{}
+		}
+
+		if hit.Opaque(rec) {
+			return true, rec
+		}
+
+		intvl = Interval{math.Nextafter(rec.t, math.MaxFloat64), intvl.max}
+	}
+}
+
+func (hit Cutout) Opaque(rec HitRecord) bool {
+	opacity := hit.opacity.Value(rec.u, rec.v, rec.p).Average()
+	if hit.threshold > 0 {
+		return opacity >= hit.threshold
+	}
+	return opacity > rand.Float64()
+}
+
+func (hit Cutout) BoundingBox() AABB {
+	return hit.object.BoundingBox()
+}
+
+func (hit Cutout) PDFValue(origin Point3, direction Vec3) float64 {
+	return hit.object.PDFValue(origin, direction)
+}
+
+func (hit Cutout) Random(origin Point3, s Sampler) Vec3 {
+	return hit.object.Random(origin, s)
+}
+
 type ConstantMedium struct {
 	boundary      Hittable
 	negInvDensity float64
@@ -563,7 +792,9 @@ func (hit ConstantMedium) Hit(r Ray, intvl Interval) (bool, HitRecord) {
 	rec.p = r.At(rec.t)
 
 	rec.normal = Vec3{1, 0, 0} // arbitrary
-	rec.frontFace = true       // also arbitrary
+	rec.geomNormal = rec.normal
+	rec.objectP, rec.objectNormal = rec.p, rec.normal
+	rec.frontFace = true // also arbitrary
 	rec.mat = hit.phaseFunction
 
 	return true, rec
@@ -577,6 +808,92 @@ func (hit ConstantMedium) PDFValue(origin Point3, direction Vec3) float64 {
 	return 0
 }
 
-func (hit ConstantMedium) Random(origin Point3) Vec3 {
+func (hit ConstantMedium) Random(origin Point3, s Sampler) Vec3 {
 	return Vec3{1, 0, 0}
 }
+
+type Subsurface struct {
+	boundary Hittable
+	sigmaT   RGB
+	albedo   RGB
+	ior      float64
+}
+
+func NewSubsurface(boundary Hittable, albedo, meanFreePath RGB, ior float64) Subsurface {
+	// A translucent volume bounded by a closed surface, rendered by a random walk inside it.
+	// The albedo is the single-scattering albedo and the mean free path is the average distance
+	// travelled between two scattering events, both given per color channel.
+	sigmaT := RGB{1 / meanFreePath.R(), 1 / meanFreePath.G(), 1 / meanFreePath.B()}
+	return Subsurface{boundary, sigmaT, albedo, ior}
+}
+
+func (hit Subsurface) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	hitAnything, rec := hit.boundary.Hit(r, Interval{intvl.min, math.MaxFloat64})
+	if !hitAnything {
+		return false, HitRecord{}
+	}
+
+	// Rays arriving from outside only see the refractive interface.
+	if rec.frontFace {
+		if !intvl.Contains(rec.t) {
+			return false, HitRecord{}
+		}
+		rec.mat = SubsurfaceInterface{hit.ior, RGB{1, 1, 1}}
+		return true, rec
+	}
+
+	// Inside the volume, pick one channel to sample the free flight distance and weight the
+	// result by the pdf averaged over all channels, so every channel stays unbiased.
+	rayLength := r.dir.Length()
+	distanceInsideBoundary := rec.t * rayLength
+	channel := rand.IntN(3)
+	hitDistance := -math.Log(1-rand.Float64()) / hit.sigmaT[channel]
+
+	if hitDistance < distanceInsideBoundary {
+		t := hitDistance / rayLength
+		if !intvl.Surrounds(t) {
+			return false, HitRecord{}
+		}
+
+		transmittance := hit.Transmittance(hitDistance)
+		pdf := hit.sigmaT.Mul(transmittance).Average()
+		weight := hit.albedo.Mul(hit.sigmaT).Mul(transmittance).Divn(pdf)
+
+		scatterRec := HitRecord{}
+		scatterRec.t = t
+		scatterRec.p = r.At(t)
+		scatterRec.normal = Vec3{1, 0, 0} // arbitrary
+		scatterRec.geomNormal = scatterRec.normal
+		scatterRec.objectP, scatterRec.objectNormal = scatterRec.p, scatterRec.normal
+		scatterRec.frontFace = true // also arbitrary
+		scatterRec.mat = SubsurfacePhase{weight}
+		return true, scatterRec
+	}
+
+	if !intvl.Contains(rec.t) {
+		return false, HitRecord{}
+	}
+
+	transmittance := hit.Transmittance(distanceInsideBoundary)
+	pdf := transmittance.Average()
+	rec.mat = SubsurfaceInterface{hit.ior, transmittance.Divn(pdf)}
+
+	return true, rec
+}
+
+func (hit Subsurface) Transmittance(distance float64) RGB {
+	// Returns the fraction of light per channel that travels the distance without scattering.
+	return RGB{math.Exp(-hit.sigmaT[0] * distance), math.Exp(-hit.sigmaT[1] * distance), math.Exp(-hit.sigmaT[2] * distance)}
+}
+
+func (hit Subsurface) BoundingBox() AABB {
+	return hit.boundary.BoundingBox()
+}
+
+func (hit Subsurface) PDFValue(origin Point3, direction Vec3) float64 {
+	return hit.boundary.PDFValue(origin, direction)
+}
+
+func (hit Subsurface) Random(origin Point3, s Sampler) Vec3 {
+	return hit.boundary.Random(origin, s)
+}
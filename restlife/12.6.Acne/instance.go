@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+// Affine transform as the top three rows of a 4x4 matrix, kept along with its inverse.
+type Transform struct {
+	m   [3][4]float64
+	inv [3][4]float64
+}
+
+func NewTransform() Transform {
+	identity := [3][4]float64{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}}
+	return Transform{identity, identity}
+}
+
+func Translation(offset Vec3) Transform {
+	t := NewTransform()
+	for i := range 3 {
+		t.m[i][3] = offset[i]
+		t.inv[i][3] = -offset[i]
+	}
+	return t
+}
+
+func Scaling(scale Vec3) Transform {
+	t := NewTransform()
+	for i := range 3 {
+		t.m[i][i] = scale[i]
+		t.inv[i][i] = 1 / scale[i]
+	}
+	return t
+}
+
+func RotationY(angle float64) Transform {
+	// Rotates by angle degrees around the Y axis, the same way as RotateY.
+	radians := Radians(angle)
+	sinTheta, cosTheta := math.Sin(radians), math.Cos(radians)
+	t := NewTransform()
+	t.m[0][0], t.m[0][2] = cosTheta, sinTheta
+	t.m[2][0], t.m[2][2] = -sinTheta, cosTheta
+	t.inv[0][0], t.inv[0][2] = cosTheta, -sinTheta
+	t.inv[2][0], t.inv[2][2] = sinTheta, cosTheta
+	return t
+}
+
+func RotationAxis(axis Vec3, angle float64) Transform {
+	// Rotates by angle degrees around the axis through the origin, following Rodrigues.
+	a := axis.Normalize()
+	radians := Radians(angle)
+	s, c := math.Sin(radians), math.Cos(radians)
+	t := NewTransform()
+	for i := range 3 {
+		for j := range 3 {
+			value := a[i] * a[j] * (1 - c)
+			if i == j {
+				value += c
+			} else {
+				// Cross product matrix of the axis, with the sign of the missing index.
+				k := 3 - i - j
+				sign := 1.0
+				if (j-i+3)%3 == 2 {
+					sign = -1
+				}
+				value -= sign * a[k] * s
+			}
+			t.m[i][j] = value
+			t.inv[j][i] = value
+		}
+	}
+	return t
+}
+
+func (t Transform) Then(next Transform) Transform {
+	// Returns the transform applying t first, then next.
+	return Transform{MultiplyAffine(next.m, t.m), MultiplyAffine(t.inv, next.inv)}
+}
+
+func (t Transform) Inverse() Transform {
+	return Transform{t.inv, t.m}
+}
+
+func MultiplyAffine(a, b [3][4]float64) [3][4]float64 {
+	// Product of two affine matrices, with the implicit bottom row (0, 0, 0, 1).
+	var result [3][4]float64
+	for i := range 3 {
+		for j := range 4 {
+			for k := range 3 {
+				result[i][j] += a[i][k] * b[k][j]
+			}
+		}
+		result[i][3] += a[i][3]
+	}
+	return result
+}
+
+func ApplyPoint(m [3][4]float64, p Point3) Point3 {
+	return Point3{
+		m[0][0]*p[0] + m[0][1]*p[1] + m[0][2]*p[2] + m[0][3],
+		m[1][0]*p[0] + m[1][1]*p[1] + m[1][2]*p[2] + m[1][3],
+		m[2][0]*p[0] + m[2][1]*p[1] + m[2][2]*p[2] + m[2][3],
+	}
+}
+
+func ApplyVector(m [3][4]float64, v Vec3) Vec3 {
+	return Vec3{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+func (t Transform) Point(p Point3) Point3 {
+	return ApplyPoint(t.m, p)
+}
+
+func (t Transform) Vector(v Vec3) Vec3 {
+	return ApplyVector(t.m, v)
+}
+
+func (t Transform) Normal(n Vec3) Vec3 {
+	// Normals transform by the inverse transpose, to stay perpendicular to the surface under
+	// non-uniform scaling.
+	inv := t.inv
+	return Vec3{
+		inv[0][0]*n[0] + inv[1][0]*n[1] + inv[2][0]*n[2],
+		inv[0][1]*n[0] + inv[1][1]*n[1] + inv[2][1]*n[2],
+		inv[0][2]*n[0] + inv[1][2]*n[1] + inv[2][2]*n[2],
+	}.Normalize()
+}
+
+func (t Transform) Box(bbox AABB) AABB {
+	// Bounding box of the eight transformed corners.
+	result := EmptyAABB
+	for i := range 2 {
+		for j := range 2 {
+			for k := range 2 {
+				corner := Point3{bbox[0].min, bbox[1].min, bbox[2].min}
+				if i == 1 {
+					corner[0] = bbox[0].max
+				}
+				if j == 1 {
+					corner[1] = bbox[1].max
+				}
+				if k == 1 {
+					corner[2] = bbox[2].max
+				}
+				p := t.Point(corner)
+				result = NewAABBBox(result, NewAABBPoint(p, p))
+			}
+		}
+	}
+	return result
+}
+
+// An Instance places a shared object, usually the BVH of an asset built once, into the world
+// with its own transform, and optionally its own material. Thousands of instances of one asset
+// cost a transform each rather than a copy of its geometry, and a BVH over the instances makes
+// the top level of a two-level acceleration structure.
+type Instance struct {
+	object    Hittable
+	transform Transform
+	mat       Material // Overrides the materials of the object, unless nil
+	bbox      AABB
+}
+
+func NewInstance(object Hittable, transform Transform, mat Material) Instance {
+	return Instance{object, transform, mat, transform.Box(object.BoundingBox())}
+}
+
+func (hit Instance) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	// Transform the ray into object space. The direction isn't normalized, so t is the same
+	// in both spaces.
+	objectRay := Ray{ApplyPoint(hit.transform.inv, r.orig), ApplyVector(hit.transform.inv, r.dir), r.tm}
+
+	hitAnything, rec := hit.object.Hit(objectRay, intvl)
+	if !hitAnything {
+		return false, HitRecord{}
+	}
+
+	// Transform the intersection from object space back to world space.
+	rec.p = hit.transform.Point(rec.p)
+	rec.normal = hit.transform.Normal(rec.normal)
+	rec.geomNormal = hit.transform.Normal(rec.geomNormal)
+	rec.dpdu = hit.transform.Vector(rec.dpdu)
+	rec.dpdv = hit.transform.Vector(rec.dpdv)
+	if hit.mat != nil {
+		rec.mat = hit.mat
+	}
+
+	return true, rec
+}
+
+func (hit Instance) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Instance) PDFValue(origin Point3, direction Vec3) float64 {
+	// Solid angles are kept by rotations, translations and uniform scaling, so the density
+	// of the object can be used as is for those.
+	return hit.object.PDFValue(ApplyPoint(hit.transform.inv, origin), ApplyVector(hit.transform.inv, direction))
+}
+
+func (hit Instance) Random(origin Point3, s Sampler) Vec3 {
+	return hit.transform.Vector(hit.object.Random(ApplyPoint(hit.transform.inv, origin), s))
+}
+
+// The unit cube, shared by every box made with NewBoxInstance. It has no material of its
+// own, built the first time a box needs it.
+var UnitBox = sync.OnceValue(func() BVHNode {
+	return NewBVHNode(Box(Point3{0, 0, 0}, Point3{1, 1, 1}, nil))
+})
+
+func NewBoxInstance(a, b Point3, mat Material) Instance {
+	// Returns the 3D box (six sides) that contains the two opposite vertices a & b, as an
+	// instance of the shared unit cube. The cube has no material, so the box must bring one.
+	if mat == nil {
+		log.Fatal("NewBoxInstance needs a material, the shared unit cube has none")
+	}
+	low := Point3{math.Min(a.X(), b.X()), math.Min(a.Y(), b.Y()), math.Min(a.Z(), b.Z())}
+	high := Point3{math.Max(a.X(), b.X()), math.Max(a.Y(), b.Y()), math.Max(a.Z(), b.Z())}
+	return NewInstance(UnitBox(), Scaling(high.Sub(low)).Then(Translation(low)), mat)
+}
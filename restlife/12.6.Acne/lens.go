@@ -0,0 +1,160 @@
+package main
+
+import "math"
+
+// An Aperture is the shape of the opening of a lens, which gives out of focus highlights
+// (bokeh) their shape.
+type Aperture interface {
+	// Maps a 2D sample to a uniformly distributed point of the aperture, within the unit
+	// disk.
+	Sample(r1, r2 float64) (float64, float64)
+}
+
+type CircularAperture struct{}
+
+func (a CircularAperture) Sample(r1, r2 float64) (float64, float64) {
+	p := SampleUnitDisk(r1, r2)
+	return p[0], p[1]
+}
+
+type PolygonAperture struct {
+	blades   int     // Number of diaphragm blades, the sides of the polygon
+	rotation float64 // Rotation of the polygon, in degrees
+}
+
+func (a PolygonAperture) Sample(r1, r2 float64) (float64, float64) {
+	// Pick one of the equal triangles between the center and the sides, then a uniform point
+	// in it, reusing the first dimension within the triangle.
+	k := min(int(r1*float64(a.blades)), a.blades-1)
+	angle := 2 * math.Pi / float64(a.blades)
+	start := Radians(a.rotation) + float64(k)*angle
+	s, t := r1*float64(a.blades)-float64(k), r2
+	if s+t > 1 {
+		s, t = 1-s, 1-t
+	}
+	x := s*math.Cos(start) + t*math.Cos(start+angle)
+	y := s*math.Sin(start) + t*math.Sin(start+angle)
+	return x, y
+}
+
+type ImageAperture struct {
+	// Aperture mask from an image covering the unit disk's bounding square, the openness of
+	// each pixel being the average of its channels.
+	width, height int
+	cdf           []float64
+}
+
+func NewImageAperture(filename string) ImageAperture {
+	image := NewRTWImageColorSpace(filename, ColorRaw)
+	a := ImageAperture{width: image.width, height: image.height, cdf: make([]float64, image.width*image.height)}
+	total := 0.0
+	for j := range image.height {
+		for i := range image.width {
+			total += math.Max(image.Get(i, j).Average(), 0)
+			a.cdf[j*image.width+i] = total
+		}
+	}
+	return a
+}
+
+func (a ImageAperture) Sample(r1, r2 float64) (float64, float64) {
+	// Pick a pixel in proportion to its openness with the first dimension, then a point
+	// within it with where the first dimension fell in the pixel's share and the second.
+	total := a.cdf[len(a.cdf)-1]
+	if total <= 0 {
+		return 0, 0
+	}
+	x := r1 * total
+	lo, hi := 0, len(a.cdf)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if a.cdf[mid] < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	i, j := lo%a.width, lo/a.width
+	previous := 0.0
+	if lo > 0 {
+		previous = a.cdf[lo-1]
+	}
+	s := (float64(i) + Clamp((x-previous)/(a.cdf[lo]-previous), 0, OneMinusEpsilon)) / float64(a.width)
+	t := (float64(j) + r2) / float64(a.height)
+	return 2*s - 1, 1 - 2*t
+}
+
+type LensProjection struct {
+	// Thin lens camera in physical units. Lengths on the camera side are in millimeters, and
+	// the scene is in meters unless sceneScale says how many scene units make a meter. The
+	// lens focuses at the camera focusDist, in scene units.
+	focalLength float64 // Focal length in mm
+	fStop       float64 // Focal length over the aperture diameter
+	sensorWidth float64 // Width of the sensor in mm, its height following the image aspect
+	sceneScale  float64 // Scene units per meter
+	aperture    Aperture
+	catEye      float64    // Strength of the clipping of the aperture by the lens barrel away from the image center, from 0 to 1
+	shift       [2]float64 // Horizontal and vertical shift of the lens in mm, which moves the framing without changing the perspective
+	tilt        [2]float64 // Tilt of the plane of focus in degrees, around the horizontal and vertical axes of the camera
+}
+
+func NewLensProjection(focalLength, fStop float64) LensProjection {
+	// A lens on a full frame sensor, with a round aperture.
+	return LensProjection{
+		focalLength: focalLength,
+		fStop:       fStop,
+		sensorWidth: 36,
+		sceneScale:  1,
+		aperture:    CircularAperture{},
+	}
+}
+
+func (p LensProjection) Initialize(c *Camera) {
+	sensorHeight := p.sensorWidth * float64(c.filmHeight) / float64(c.filmWidth)
+	c.spreadAngle = math.Atan(sensorHeight / float64(c.filmHeight) / p.focalLength)
+}
+
+func (p LensProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	// Position on the sensor in mm from its center, up and to the right, seen in front of the
+	// lens so the image isn't flipped. Shifting the lens slides the sensor under it.
+	sensorHeight := p.sensorWidth * float64(c.filmHeight) / float64(c.filmWidth)
+	sx := (x/float64(c.filmWidth)-0.5)*p.sensorWidth + p.shift[0]
+	sy := (0.5-y/float64(c.filmHeight))*sensorHeight + p.shift[1]
+
+	// Sample the aperture. Off axis, the lens barrel cuts into the aperture from the side of
+	// the image center, blocking part of the light and turning bokeh into cat's eyes.
+	ax, ay := p.aperture.Sample(lensU, lensV)
+	if p.catEye > 0 {
+		halfDiagonal := math.Hypot(p.sensorWidth, sensorHeight) / 2
+		cx, cy := -2*p.catEye*sx/halfDiagonal, -2*p.catEye*sy/halfDiagonal
+		if math.Hypot(ax-cx, ay-cy) > 1 {
+			return Point3{}, Vec3{}, false
+		}
+	}
+
+	// The ray through the center of the lens isn't bent, and meets the others where it
+	// crosses the plane of focus. A tilted plane of focus makes the Scheimpflug effect.
+	chief := c.u.Muln(sx).Add(c.v.Muln(sy)).Sub(c.w.Muln(p.focalLength))
+	focusNormal := c.w
+	if p.tilt != [2]float64{} {
+		tilt := RotationAxis(c.u, p.tilt[0]).Then(RotationAxis(c.v, p.tilt[1]))
+		focusNormal = tilt.Vector(c.w)
+	}
+	denom := chief.Dot(focusNormal)
+	if math.Abs(denom) < 1e-12 {
+		return Point3{}, Vec3{}, false
+	}
+	focusT := -c.focusDist * c.w.Dot(focusNormal) / denom
+	if focusT <= 0 {
+		return Point3{}, Vec3{}, false
+	}
+	focusPoint := c.center.Add(chief.Muln(focusT))
+
+	apertureRadius := p.focalLength / p.fStop / 2 / 1000 * p.sceneScale
+	orig := c.center.Add(c.u.Muln(ax * apertureRadius)).Add(c.v.Muln(ay * apertureRadius))
+	return orig, focusPoint.Sub(orig), true
+}
+
+func (p LensProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return c.u
+}
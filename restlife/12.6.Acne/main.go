@@ -1,6 +1,32 @@
 package main
 
-func main() {
+import (
+	"flag"
+	"log"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+var (
+	basepath string
+	rootpath string
+)
+
+func init() {
+	_, exepath, _, _ := runtime.Caller(0)
+	basepath = filepath.Dir(exepath)
+	rootpath = filepath.Dir(filepath.Dir(basepath))
+}
+
+func CornellBox() {
+	world, lights, cam := CornellBoxScene()
+	cam.Render(world, lights)
+}
+
+func CornellBoxScene() (HittableList, HittableList, Camera) {
 	world := HittableList{}
 
 	red := Lambertian{NewSolidColor(0.65, 0.05, 0.05)}
@@ -44,5 +70,819 @@ func main() {
 
 	cam.defocusAngle = 0
 
+	// Owen scrambled Sobol points converge faster than jittered ones, with any sample count.
+	cam.sampler = &SobolSampler{}
+
+	// Spend the samples where the glass and the indirect light leave the most noise.
+	cam.adaptiveThreshold = 0.03
+
+	// Passes for compositing and denoising, written next to the image.
+	cam.aovs = []AOV{AOVAlbedo, AOVNormal, AOVDepth, AOVObjectID, AOVDirect, AOVIndirect}
+
+	return world, lights, cam
+}
+
+func CornellSubsurface() {
+	world := HittableList{}
+
+	red := Lambertian{NewSolidColor(0.65, 0.05, 0.05)}
+	white := Lambertian{NewSolidColor(0.73, 0.73, 0.73)}
+	green := Lambertian{NewSolidColor(0.12, 0.45, 0.15)}
+	light := DiffuseLight{NewSolidColor(15, 15, 15)}
+
+	// Cornell box sides
+	world.Add(NewQuad(Point3{555, 0, 0}, Vec3{0, 0, 555}, Vec3{0, 555, 0}, green))
+	world.Add(NewQuad(Point3{0, 0, 555}, Vec3{0, 0, -555}, Vec3{0, 555, 0}, red))
+	world.Add(NewQuad(Point3{0, 555, 0}, Vec3{555, 0, 0}, Vec3{0, 0, 555}, white))
+	world.Add(NewQuad(Point3{0, 0, 555}, Vec3{555, 0, 0}, Vec3{0, 0, -555}, white))
+	world.Add(NewQuad(Point3{555, 0, 555}, Vec3{-555, 0, 0}, Vec3{0, 555, 0}, white))
+
+	// Light
+	world.Add(NewQuad(Point3{213, 554, 227}, Vec3{130, 0, 0}, Vec3{0, 0, 105}, light))
+
+	// Marble box
+	marble := Box(Point3{0, 0, 0}, Point3{165, 330, 165}, EmptyMaterial{})
+	world.Add(NewTranslate(NewRotateY(NewSubsurface(marble, RGB{0.999, 0.998, 0.995}, RGB{8, 9, 12}, 1.5), 15), Vec3{265, 0, 295}))
+
+	// Wax Sphere
+	wax := NewSphere(Point3{190, 90, 190}, 90, EmptyMaterial{})
+	world.Add(NewSubsurface(wax, RGB{0.99, 0.9, 0.6}, RGB{20, 8, 4}, 1.45))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{343, 554, 332}, Vec3{-130, 0, 0}, Vec3{0, 0, -105}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 1.0
+	cam.imageWidth = 600
+	cam.samplesPerPixel = 1000
+	cam.maxDepth = 200
+	cam.background = RGB{0, 0, 0}
+
+	cam.vfov = 40
+	cam.lookfrom = Point3{278, 278, -800}
+	cam.lookat = Point3{278, 278, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func BumpedSpheres() {
+	world := HittableList{}
+
+	pertext := NewNoiseTextureSeeded(4, 1, 0)
+	checker := NewCheckerTexture(0.5, NewSolidColor(0.2, 0.2, 0.2), NewSolidColor(0.8, 0.8, 0.8))
+	world.Add(NewQuad(Point3{-10, 0, -10}, Vec3{20, 0, 0}, Vec3{0, 0, 20}, BumpMap{Lambertian{NewSolidColor(0.6, 0.6, 0.6)}, checker, 0.05}))
+	world.Add(NewSphere(Point3{-2.2, 2, 0}, 2, BumpMap{Lambertian{NewSolidColor(0.8, 0.6, 0.4)}, pertext, 0.5}))
+	world.Add(NewSphere(Point3{2.2, 2, 0}, 2, BumpMap{Metal{RGB{0.8, 0.8, 0.9}, 0.0}, pertext, 0.5}))
+
+	light := DiffuseLight{NewSolidColor(4, 4, 4)}
+	world.Add(NewQuad(Point3{-3, 8, -3}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, light))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{-3, 8, -3}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.1, 0.1, 0.15}
+
+	cam.vfov = 30
+	cam.lookfrom = Point3{0, 4, 14}
+	cam.lookat = Point3{0, 1.5, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func Earth() {
+	world := HittableList{}
+
+	// A small, distant globe minifies the texture a lot, which aliases without mipmapping.
+	earthTexture := NewImageTextureFiltered(filepath.Join(rootpath, "textures", "earthmap.jpg"), ColorSRGB, FilterTrilinear, WrapRepeat)
+	world.Add(NewSphere(Point3{0, 0, 0}, 2, Lambertian{earthTexture}))
+
+	sun := DiffuseLight{NewSolidColor(10, 10, 10)}
+	world.Add(NewQuad(Point3{20, -5, 10}, Vec3{0, 10, 0}, Vec3{0, 0, 10}, sun))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{20, -5, 10}, Vec3{0, 10, 0}, Vec3{0, 0, 10}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.70, 0.80, 1.00}
+
+	cam.vfov = 20
+	cam.lookfrom = Point3{0, 0, 60}
+	cam.lookat = Point3{0, 0, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func Fence() {
+	world := HittableList{}
+
+	ground := Lambertian{NewSolidColor(0.48, 0.83, 0.53)}
+	world.Add(NewQuad(Point3{-10, 0, -10}, Vec3{20, 0, 0}, Vec3{0, 0, 20}, ground))
+	world.Add(NewSphere(Point3{0, 1, -2}, 1, Lambertian{NewSolidColor(0.8, 0.3, 0.1)}))
+
+	// A checker used as opacity punches square holes into the fence.
+	holes := NewCheckerTexture(0.15, NewSolidColor(1, 1, 1), NewSolidColor(0, 0, 0))
+	fence := NewQuad(Point3{-4, 0, 0.5}, Vec3{8, 0, 0}, Vec3{0, 2.5, 0}, Metal{RGB{0.7, 0.7, 0.7}, 0.3})
+	world.Add(NewCutout(fence, holes, 0.5))
+
+	light := DiffuseLight{NewSolidColor(6, 6, 6)}
+	world.Add(NewQuad(Point3{-2, 6, -2}, Vec3{4, 0, 0}, Vec3{0, 0, 4}, light))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{-2, 6, -2}, Vec3{4, 0, 0}, Vec3{0, 0, 4}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.70, 0.80, 1.00}
+
+	cam.vfov = 30
+	cam.lookfrom = Point3{2, 2, 10}
+	cam.lookat = Point3{0, 1, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
 	cam.Render(world, lights)
 }
+
+func ProceduralSpheres() {
+	world := HittableList{}
+
+	white := NewSolidColor(0.9, 0.9, 0.9)
+	rock := NewRidgedTexture(0.5, 6, 2, 0.5, 1, NewSolidColor(0.25, 0.22, 0.2), NewSolidColor(0.8, 0.75, 0.7))
+
+	// The ground repeats every 8 lattice units, 16 units at its scale, like tiles would.
+	rock.noise = NewPerlinPeriodic(6, 8)
+	world.Add(NewSphere(Point3{0, -1000, 0}, 1000, Lambertian{rock}))
+
+	clouds := NewFBMTexture(2, 6, 2, 0.5, NewSolidColor(0.2, 0.3, 0.8), white)
+	world.Add(NewSphere(Point3{-4.5, 1, 0}, 1, Lambertian{clouds}))
+
+	cells := NewWorleyTexture(3, true, NewSolidColor(0.1, 0.5, 0.2), NewSolidColor(0.02, 0.05, 0.02))
+	world.Add(NewSphere(Point3{-2.25, 1, 0}, 1, Lambertian{cells}))
+
+	wood := NewWoodTexture(4, 0.4, NewSolidColor(0.75, 0.5, 0.3), NewSolidColor(0.35, 0.18, 0.08))
+	world.Add(NewSphere(Point3{0, 1, 0}, 1, Lambertian{wood}))
+
+	ramp := NewColorRamp(ColorStop{0, RGB{0.1, 0.1, 0.12}}, ColorStop{0.5, RGB{0.6, 0.55, 0.5}}, ColorStop{1, RGB{0.95, 0.95, 0.92}})
+	marble := NewMarbleTexture(4, 10, ramp)
+	world.Add(NewSphere(Point3{2.25, 1, 0}, 1, Lambertian{marble}))
+
+	// Textures feed each other: the warp bends the wood rings into swirls.
+	warped := NewWarpTexture(wood, 1, 0.5)
+	world.Add(NewSphere(Point3{4.5, 1, 0}, 1, Lambertian{warped}))
+
+	// Floating behind them, veins that flow during the exposure, and simplex noise.
+	flowing := NewAnimatedNoiseTexture(4, 2, 8, 0)
+	world.Add(NewSphere(Point3{-1.5, 3, -5}, 1, Lambertian{flowing}))
+
+	blotches := NewSimplexTexture(3, 9, NewSolidColor(0.6, 0.15, 0.1), NewSolidColor(0.95, 0.8, 0.3))
+	world.Add(NewSphere(Point3{1.5, 3, -5}, 1, Lambertian{blotches}))
+
+	light := DiffuseLight{NewSolidColor(4, 4, 4)}
+	world.Add(NewQuad(Point3{-3, 8, -1}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, light))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{-3, 8, -1}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.70, 0.80, 1.00}
+
+	cam.vfov = 35
+	cam.lookfrom = Point3{0, 3, 12}
+	cam.lookat = Point3{0, 1, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func TextureNodes() {
+	world := HittableList{}
+
+	white := NewSolidColor(0.9, 0.9, 0.9)
+	black := NewSolidColor(0.05, 0.05, 0.05)
+
+	// A tiled, rotated UV checker on the floor, darkened by noise through a multiply blend.
+	tiles := NewUVTransform(NewUVCheckerTexture(1, 1, white, NewSolidColor(0.5, 0.1, 0.1)), 10, 10, 0, 0, 30)
+	dirt := NewRampTexture(NewNoiseTextureSeeded(0.5, 3, 0), NewColorRamp(ColorStop{0, RGB{0.4, 0.4, 0.4}}, ColorStop{1, RGB{1, 1, 1}}))
+	floor := NewBlendTexture(BlendMultiply, tiles, dirt, white)
+	world.Add(NewQuad(Point3{-10, 0, -10}, Vec3{20, 0, 0}, Vec3{0, 0, 20}, Lambertian{floor}))
+
+	// Triplanar projection in object space keeps the pattern fixed to the rotated box.
+	checker := NewUVCheckerTexture(1, 1, white, black)
+	box := Box(Point3{-1, 0, -1}, Point3{1, 2, 1}, Lambertian{NewTriplanarTexture(checker, 2, 4, SpaceObject)})
+	world.Add(NewTranslate(NewRotateY(box, 30), Vec3{-2, 0, 0}))
+
+	// Mix two colors by a world space checker mask on a sphere.
+	mask := NewCheckerTexture(0.4, white, black)
+	mix := NewBlendTexture(BlendMix, NewSolidColor(0.1, 0.3, 0.8), NewSolidColor(0.9, 0.7, 0.1), mask)
+	world.Add(NewSphere(Point3{2, 1, 0}, 1, Lambertian{mix}))
+
+	light := DiffuseLight{NewSolidColor(4, 4, 4)}
+	world.Add(NewQuad(Point3{-3, 8, -1}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, light))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{-3, 8, -1}, Vec3{6, 0, 0}, Vec3{0, 0, 6}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.70, 0.80, 1.00}
+
+	cam.vfov = 35
+	cam.lookfrom = Point3{0, 4, 10}
+	cam.lookat = Point3{0, 1, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func Primitives() {
+	world := HittableList{}
+
+	checker := NewUVTransform(NewUVCheckerTexture(1, 1, NewSolidColor(0.2, 0.3, 0.1), NewSolidColor(0.9, 0.9, 0.9)), 0.5, 0.5, 0, 0, 0)
+	world.Add(NewInfinitePlane(Point3{0, 0, 0}, Vec3{0, 1, 0}, Lambertian{checker}))
+
+	red := Lambertian{NewSolidColor(0.8, 0.2, 0.2)}
+	blue := Lambertian{NewSolidColor(0.2, 0.3, 0.8)}
+	gold := Metal{RGB{0.8, 0.6, 0.2}, 0.1}
+	world.Add(NewCylinder(Point3{-3, 0, 0}, Vec3{0, 1, 0}, 0.7, 2, red))
+	world.Add(NewDisk(Point3{-3, 2, 0}, Vec3{0, 1, 0}, 0.7, red))
+	world.Add(NewCone(Point3{-1, 0, 0}, Vec3{0, 1, 0}, 0.8, 2, blue))
+	world.Add(NewTorus(Point3{1.2, 0.9, 0}, Vec3{0, 0.5, 1}, 0.7, 0.25, gold))
+	world.Add(NewTriangle(Point3{2.5, 0, -1}, Point3{4, 0, -1}, Point3{3.25, 2, -1}, blue))
+	world.Add(NewEllipse(Point3{3.2, 1.5, 1}, Vec3{0.8, 0, 0}, Vec3{0, 0.4, 0}, red))
+
+	// A glowing ring used as the light.
+	light := DiffuseLight{NewSolidColor(8, 8, 8)}
+	ring := NewTorus(Point3{0, 5, 0}, Vec3{0, 1, 0}, 2, 0.1, light)
+	world.Add(ring)
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewTorus(Point3{0, 5, 0}, Vec3{0, 1, 0}, 2, 0.1, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.05, 0.05, 0.08}
+
+	cam.vfov = 35
+	cam.lookfrom = Point3{0, 4, 11}
+	cam.lookat = Point3{0, 1, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func CornellCSG() {
+	world := HittableList{}
+
+	red := Lambertian{NewSolidColor(0.65, 0.05, 0.05)}
+	white := Lambertian{NewSolidColor(0.73, 0.73, 0.73)}
+	green := Lambertian{NewSolidColor(0.12, 0.45, 0.15)}
+	light := DiffuseLight{NewSolidColor(15, 15, 15)}
+
+	// Cornell box sides
+	world.Add(NewQuad(Point3{555, 0, 0}, Vec3{0, 0, 555}, Vec3{0, 555, 0}, green))
+	world.Add(NewQuad(Point3{0, 0, 555}, Vec3{0, 0, -555}, Vec3{0, 555, 0}, red))
+	world.Add(NewQuad(Point3{0, 555, 0}, Vec3{555, 0, 0}, Vec3{0, 0, 555}, white))
+	world.Add(NewQuad(Point3{0, 0, 555}, Vec3{555, 0, 0}, Vec3{0, 0, -555}, white))
+	world.Add(NewQuad(Point3{555, 0, 555}, Vec3{-555, 0, 0}, Vec3{0, 555, 0}, white))
+
+	// Light
+	world.Add(NewQuad(Point3{213, 554, 227}, Vec3{130, 0, 0}, Vec3{0, 0, 105}, light))
+
+	// Box with a spherical cavity carved into its top corner
+	box := Box(Point3{0, 0, 0}, Point3{165, 330, 165}, white)
+	cavity := NewSphere(Point3{165, 330, 0}, 120, white)
+	world.Add(NewTranslate(NewRotateY(NewCSG(CSGDifference, box, cavity), 15), Vec3{265, 0, 295}))
+
+	// Glass lens, the intersection of two spheres
+	glass := Dielectric{1.5}
+	lens := NewCSG(CSGIntersection, NewSphere(Point3{190, 150, 100}, 120, glass), NewSphere(Point3{190, 150, 280}, 120, glass))
+	world.Add(lens)
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{343, 554, 332}, Vec3{-130, 0, 0}, Vec3{0, 0, -105}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 1.0
+	cam.imageWidth = 600
+	cam.samplesPerPixel = 1000
+	cam.maxDepth = 50
+	cam.background = RGB{0, 0, 0}
+
+	cam.vfov = 40
+	cam.lookfrom = Point3{278, 278, -800}
+	cam.lookat = Point3{278, 278, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func DistanceFields() {
+	world := HittableList{}
+
+	ground := Lambertian{NewCheckerTexture(0.32, NewSolidColor(0.2, 0.3, 0.1), NewSolidColor(0.9, 0.9, 0.9))}
+	world.Add(NewSphere(Point3{0, -1000, 0}, 1000, ground))
+
+	// Rounded box blended smoothly into a sphere
+	blob := SDFSmoothUnion(SDFRoundBox(Point3{-2.2, 0.8, 0}, Vec3{0.7, 0.7, 0.7}, 0.15), SDFSphere(Point3{-2.2, 1.6, 0}, 0.6), 0.3)
+	blobShape := NewSDFHittable(blob, NewAABBPoint(Point3{-3.2, 0, -1}, Point3{-1.2, 2.4, 1}), Lambertian{NewSolidColor(0.8, 0.3, 0.2)})
+	blobShape.SetStepScale(0.8)
+	world.Add(blobShape)
+
+	// Twisted box
+	twisted := SDFTranslate(SDFTwist(SDFBox(Point3{0, 0, 0}, Vec3{0.4, 1, 0.4}), 1.2), Vec3{0, 1, 0})
+	twistedShape := NewSDFHittable(twisted, NewAABBPoint(Point3{-0.6, 0, -0.6}, Point3{0.6, 2, 0.6}), Metal{RGB{0.8, 0.8, 0.9}, 0.05})
+	twistedShape.SetStepScale(0.5)
+	world.Add(twistedShape)
+
+	// Glass torus with a box carved out of it
+	ring := SDFDifference(SDFTorus(Point3{2.2, 0.35, 0}, 0.8, 0.3), SDFBox(Point3{2.2, 0.35, -1}, Vec3{1, 1, 0.8}))
+	world.Add(NewSDFHittable(ring, NewAABBPoint(Point3{1.2, 0, -1.2}, Point3{3.2, 0.7, 1.2}), Dielectric{1.5}))
+
+	// Row of spheres repeated along x, cut to length by a box
+	row := SDFIntersection(SDFTranslate(SDFRepeat(SDFSphere(Point3{0, 0, 0}, 0.2), Vec3{0.6, 0, 0}), Vec3{0, 0.2, 2}), SDFBox(Point3{0, 0.2, 2}, Vec3{2.7, 0.3, 0.3}))
+	world.Add(NewSDFHittable(row, NewAABBPoint(Point3{-3, 0, 1.7}, Point3{3, 0.5, 2.3}), Lambertian{NewSolidColor(0.2, 0.4, 0.8)}))
+
+	// Mandelbulb fractal
+	bulb := SDFMandelbulb(Point3{0, 3.2, -2}, 1, 8, 12)
+	world.Add(NewSDFHittable(bulb, NewAABBPoint(Point3{-1.3, 1.9, -3.3}, Point3{1.3, 4.5, -0.7}), Lambertian{NewSolidColor(0.9, 0.7, 0.3)}))
+
+	// Light Sources
+	light := DiffuseLight{NewSolidColor(7, 7, 7)}
+	world.Add(NewQuad(Point3{-2, 7, 0}, Vec3{4, 0, 0}, Vec3{0, 0, 4}, light))
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{-2, 7, 0}, Vec3{4, 0, 0}, Vec3{0, 0, 4}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.5, 0.6, 0.8}
+
+	cam.vfov = 35
+	cam.lookfrom = Point3{0, 3, 9}
+	cam.lookat = Point3{0, 1.4, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func FinalScene(imageWidth, samplesPerPixel, maxDepth int) {
+	// Displaced terrain for the floor, subdivided as finely as the memory budget allows.
+	ground := Lambertian{NewSolidColor(0.48, 0.83, 0.53)}
+	memoryBudget := 64 << 20
+	heights := NewFBMTexture(0.004, 5, 2, 0.5, NewSolidColor(0, 0, 0), NewSolidColor(1, 1, 1))
+	heights.noise = NewPerlinSeeded(5)
+	grid := NewGridMesh(Point3{-1000, 0, -1000}, Vec3{0, 0, 2000}, Vec3{2000, 0, 0}, 8, 8)
+
+	world := HittableList{}
+
+	world.Add(NewDisplacedMesh(grid, 8, heights, 100, memoryBudget, ground))
+
+	light := DiffuseLight{NewSolidColor(7, 7, 7)}
+	world.Add(NewQuad(Point3{123, 554, 147}, Vec3{300, 0, 0}, Vec3{0, 0, 256}, light))
+
+	center1 := Point3{400, 400, 200}
+	center2 := center1.Add(Vec3{30, 0, 0})
+	sphereMaterial := Lambertian{NewSolidColor(0.7, 0.3, 0.1)}
+	world.Add(NewMotionSphere(center1, center2, 50, sphereMaterial))
+
+	world.Add(NewSphere(Point3{260, 150, 45}, 50, Dielectric{1.5}))
+	world.Add(NewSphere(Point3{0, 150, 145}, 50, Metal{RGB{0.8, 0.8, 0.9}, 1.0}))
+
+	boundary := NewSphere(Point3{360, 150, 145}, 70, Dielectric{1.5})
+	world.Add(boundary)
+	world.Add(NewConstantMedium(boundary, 0.2, NewSolidColor(0.2, 0.4, 0.9)))
+	boundary = NewSphere(Point3{0, 0, 0}, 5000, Dielectric{1.5})
+	world.Add(NewConstantMedium(boundary, 0.0001, NewSolidColor(1, 1, 1)))
+
+	emat := Lambertian{NewImageTexture(filepath.Join(rootpath, "textures", "earthmap.jpg"))}
+	world.Add(NewSphere(Point3{400, 200, 400}, 100, emat))
+	pertext := NewNoiseTextureSeeded(0.2, 7, 0)
+	world.Add(NewSphere(Point3{220, 280, 300}, 80, Lambertian{pertext}))
+
+	// One sphere shared by a thousand instances, placed the same way every time so the
+	// render can be resumed from its checkpoint.
+	rng := rand.New(rand.NewPCG(11, 0))
+	boxes2 := HittableList{}
+	white := Lambertian{NewSolidColor(0.73, 0.73, 0.73)}
+	sphereAsset := NewSphere(Point3{0, 0, 0}, 10, white)
+	ns := 1000
+	for range ns {
+		offset := Vec3{165 * rng.Float64(), 165 * rng.Float64(), 165 * rng.Float64()}
+		boxes2.Add(NewInstance(sphereAsset, Translation(offset), nil))
+	}
+
+	world.Add(NewTranslate(NewRotateY(NewBVHNode(boxes2), 15), Vec3{-100, 270, 395}))
+
+	// Light Sources
+	lights := HittableList{}
+	lights.Add(NewQuad(Point3{123, 554, 147}, Vec3{300, 0, 0}, Vec3{0, 0, 256}, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 1.0
+	cam.imageWidth = imageWidth
+	cam.samplesPerPixel = samplesPerPixel
+	cam.maxDepth = maxDepth
+	cam.background = RGB{0, 0, 0}
+
+	cam.vfov = 40
+	cam.lookfrom = Point3{478, 278, -600}
+	cam.lookat = Point3{278, 278, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	// Sharper edges than the box filter, with less aliasing.
+	cam.filter = NewMitchellFilter(2)
+
+	// Long renders write the image so far every few minutes, along with a checkpoint to
+	// resume them from, or to add samples to later.
+	cam.snapshotInterval = 5 * time.Minute
+	cam.checkpointFile = "3-12.6.checkpoint"
+
+	cam.Render(world, lights)
+}
+
+func Terrain() {
+	world := HittableList{}
+
+	// Relief of the earth map, with the map itself as texture
+	earthHeights := NewRTWImageColorSpace(filepath.Join(rootpath, "textures", "earthmap.jpg"), ColorRaw)
+	earthTexture := NewImageTexture(filepath.Join(rootpath, "textures", "earthmap.jpg"))
+	world.Add(NewHeightfieldImage(earthHeights, Point3{-10, 0, -5}, Vec3{20, 0.8, 10}, Lambertian{earthTexture}))
+
+	// Hills behind it, sampled from fractal noise
+	hillHeights := NewFBMTexture(0.15, 5, 2, 0.5, NewSolidColor(0, 0, 0), NewSolidColor(1, 1, 1))
+	hillHeights.noise = NewPerlinSeeded(12)
+	world.Add(NewHeightfieldTexture(hillHeights, 256, 128, Point3{-20, 0, -25}, Vec3{40, 3, 20}, Lambertian{NewSolidColor(0.4, 0.5, 0.3)}))
+
+	// Rock made from a subdivided cube displaced by noise, within a 16 MB budget
+	cube := NewMesh([]Point3{{-1, -1, -1}, {1, -1, -1}, {1, 1, -1}, {-1, 1, -1}, {-1, -1, 1}, {1, -1, 1}, {1, 1, 1}, {-1, 1, 1}}, nil,
+		[][]int{{0, 3, 2, 1}, {4, 5, 6, 7}, {0, 1, 5, 4}, {2, 3, 7, 6}, {1, 2, 6, 5}, {0, 4, 7, 3}})
+	rockHeights := NewFBMTexture(3, 6, 2, 0.5, NewSolidColor(-1, -1, -1), NewSolidColor(1, 1, 1))
+	rock := NewDisplacedMesh(cube, 6, rockHeights, 0.5, 16<<20, Lambertian{NewSolidColor(0.5, 0.45, 0.4)})
+	world.Add(NewTranslate(rock, Vec3{0, 1.5, 1}))
+
+	// Light Sources
+	light := DiffuseLight{NewSolidColor(10, 10, 10)}
+	world.Add(NewSphere(Point3{-6, 12, 6}, 2, light))
+	lights := HittableList{}
+	lights.Add(NewSphere(Point3{-6, 12, 6}, 2, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.5, 0.6, 0.8}
+
+	cam.vfov = 40
+	cam.lookfrom = Point3{0, 8, 14}
+	cam.lookat = Point3{0, 0, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func Forest() {
+	world := HittableList{}
+
+	heights := NewFBMTexture(0.08, 5, 2, 0.5, NewSolidColor(0, 0, 0), NewSolidColor(1, 1, 1))
+	terrain := NewHeightfieldTexture(heights, 256, 256, Point3{-30, 0, -30}, Vec3{60, 4, 60}, Lambertian{NewSolidColor(0.35, 0.3, 0.2)})
+	world.Add(terrain)
+
+	// Tree assets, each built once and shared by every tree
+	bark := Lambertian{NewSolidColor(0.3, 0.2, 0.1)}
+	trunk := NewCylinder(Point3{0, -0.2, 0}, Vec3{0, 1, 0}, 0.08, 0.8, bark)
+	foliage := HittableList{}
+	foliage.Add(NewCone(Point3{0, 0.5, 0}, Vec3{0, 1, 0}, 0.5, 0.9, nil))
+	foliage.Add(NewCone(Point3{0, 0.9, 0}, Vec3{0, 1, 0}, 0.38, 0.8, nil))
+	foliageAsset := NewBVHNode(foliage)
+
+	// Thousands of trees standing on the terrain, each with its own foliage color. Positions
+	// where the probe misses the ground are drawn again rather than planting a tree at the
+	// origin.
+	trees := HittableList{}
+	for planted := 0; planted < 2000; {
+		x, z := RandomRange(-29, 29), RandomRange(-29, 29)
+		hit, rec := terrain.Hit(Ray{Point3{x, 100, z}, Vec3{0, -1, 0}, 0}, Interval{0, math.Inf(1)})
+		if !hit {
+			continue
+		}
+		scale := RandomRange(0.6, 1.4)
+		transform := Scaling(Vec3{scale, scale, scale}).Then(RotationY(RandomRange(0, 360))).Then(Translation(rec.p))
+		leaves := Lambertian{NewSolidColor(RandomRange(0.05, 0.3), RandomRange(0.25, 0.5), RandomRange(0.05, 0.15))}
+		trees.Add(NewInstance(trunk, transform, nil))
+		trees.Add(NewInstance(foliageAsset, transform, leaves))
+		planted++
+	}
+	world.Add(NewBVHNode(trees))
+
+	// Light Sources
+	light := DiffuseLight{NewSolidColor(15, 14, 12)}
+	world.Add(NewSphere(Point3{-20, 30, -10}, 4, light))
+	lights := HittableList{}
+	lights.Add(NewSphere(Point3{-20, 30, -10}, 4, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.5, 0.6, 0.8}
+
+	cam.vfov = 40
+	cam.lookfrom = Point3{0, 10, 32}
+	cam.lookat = Point3{0, 1, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func HairAndGrass() {
+	world := HittableList{}
+
+	// Lawn
+	lawn := NewQuad(Point3{-4, 0, -4}, Vec3{0, 0, 8}, Vec3{8, 0, 0}, Lambertian{NewSolidColor(0.25, 0.2, 0.1)})
+	world.Add(lawn)
+	world.Add(NewGrass(PlanarSampler(lawn), 30000, 0.35, 0.03, Lambertian{NewSolidColor(0.2, 0.5, 0.1)}))
+
+	// Fur ball grown from a subdivided cube
+	cube := NewMesh([]Point3{{-1, -1, -1}, {1, -1, -1}, {1, 1, -1}, {-1, 1, -1}, {-1, -1, 1}, {1, -1, 1}, {1, 1, 1}, {-1, 1, 1}}, nil,
+		[][]int{{0, 3, 2, 1}, {4, 5, 6, 7}, {0, 1, 5, 4}, {2, 3, 7, 6}, {1, 2, 6, 5}, {0, 4, 7, 3}})
+	ball := cube.Refine(3, 0)
+	fur := Hair{NewSolidColor(0.8, 0.5, 0.25), 0.3, 0.05}
+	strands := HittableList{}
+	root := MeshSampler(ball)
+	for range 20000 {
+		p, n := root()
+		droop := Vec3{0, -0.15, 0}
+		cp := [4]Point3{p, p.Add(n.Muln(0.1)), p.Add(n.Muln(0.2)).Add(droop.Muln(0.5)), p.Add(n.Muln(0.3)).Add(droop)}
+		for _, seg := range NewCurve(cp, 0.012, 0.002, CurveCylinder, fur).objects {
+			strands.Add(seg)
+		}
+	}
+	world.Add(NewTranslate(NewBVHNode(ball.Tessellate(fur)), Vec3{0, 1.2, 0}))
+	world.Add(NewTranslate(NewBVHNode(strands), Vec3{0, 1.2, 0}))
+
+	// Light Sources
+	light := DiffuseLight{NewSolidColor(12, 12, 10)}
+	world.Add(NewSphere(Point3{3, 6, 4}, 1.5, light))
+	lights := HittableList{}
+	lights.Add(NewSphere(Point3{3, 6, 4}, 1.5, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 16.0 / 9.0
+	cam.imageWidth = 400
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.5, 0.6, 0.8}
+
+	cam.vfov = 35
+	cam.lookfrom = Point3{0, 2.5, 7}
+	cam.lookat = Point3{0, 0.9, 0}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	cam.Render(world, lights)
+}
+
+func CameraModels() {
+	world := HittableList{}
+
+	ground := Lambertian{NewCheckerTexture(0.5, NewSolidColor(0.2, 0.3, 0.1), NewSolidColor(0.9, 0.9, 0.9))}
+	world.Add(NewSphere(Point3{0, -1000, 0}, 1000, ground))
+
+	// A ring of spheres around the camera, so every direction has something to see
+	for k := range 12 {
+		angle := 2 * math.Pi * float64(k) / 12
+		center := Point3{6 * math.Sin(angle), 1, -6 * math.Cos(angle)}
+		var mat Material = Lambertian{NewSolidColor(0.5+0.5*math.Sin(angle), 0.5, 0.5+0.5*math.Cos(angle))}
+		if k%3 == 0 {
+			mat = Metal{RGB{0.8, 0.8, 0.8}, 0.05}
+		}
+		world.Add(NewSphere(center, 1, mat))
+	}
+
+	// Light Sources
+	light := DiffuseLight{NewSolidColor(10, 10, 10)}
+	world.Add(NewSphere(Point3{0, 12, 0}, 3, light))
+	lights := HittableList{}
+	lights.Add(NewSphere(Point3{0, 12, 0}, 3, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 2.0
+	cam.imageWidth = 800
+	cam.samplesPerPixel = 100
+	cam.maxDepth = 50
+	cam.background = RGB{0.5, 0.6, 0.8}
+
+	cam.vfov = 60
+	cam.lookfrom = Point3{0, 1.5, 0}
+	cam.lookat = Point3{0, 1.5, -1}
+	cam.vup = Vec3{0, 1, 0}
+
+	cam.defocusAngle = 0
+
+	// Swap in any other projection, or render a stereo pair with cam.stereo.
+	switch 1 {
+	case 1:
+		cam.projection = EquirectangularProjection{}
+	case 2:
+		cam.projection = CylindricalProjection{360}
+	case 3:
+		cam.projection = FisheyeProjection{180, FisheyeEquisolid}
+	case 4:
+		cam.projection = OrthographicProjection{8}
+		cam.lookfrom = Point3{0, 20, 0.01}
+		cam.lookat = Point3{0, 0, 0}
+	case 5:
+		cam.projection = EquirectangularProjection{}
+		cam.aspectRadio = 1.0
+		cam.stereo = StereoOverUnder
+		cam.eyeSeparation = 0.065
+	}
+
+	cam.Render(world, lights)
+}
+
+func LensEffects() {
+	world := HittableList{}
+
+	ground := Lambertian{NewCheckerTexture(0.5, NewSolidColor(0.2, 0.3, 0.1), NewSolidColor(0.9, 0.9, 0.9))}
+	world.Add(NewSphere(Point3{0, -1000, 0}, 1000, ground))
+
+	// Subject in focus two meters away
+	world.Add(NewSphere(Point3{0, 0.3, -2}, 0.3, Lambertian{NewSolidColor(0.8, 0.3, 0.2)}))
+
+	// Small bright lights far behind, which blur into the shape of the aperture
+	for k := range 40 {
+		center := Point3{RandomRange(-8, 8), RandomRange(0.5, 6), RandomRange(-25, -15)}
+		world.Add(NewSphere(center, 0.05, DiffuseLight{NewSolidColor(RandomRange(20, 80), RandomRange(20, 60), float64(k%3)*20)}))
+	}
+
+	// Tall buildings, to keep their verticals parallel with a shifted lens
+	for k := range 6 {
+		x := -6 + 2.4*float64(k)
+		world.Add(NewBoxInstance(Point3{x, 0, -12}, Point3{x + 1.2, RandomRange(4, 9), -11}, Lambertian{NewSolidColor(0.6, 0.6, 0.65)}))
+	}
+
+	// Light Sources
+	sun := DiffuseLight{NewSolidColor(8, 8, 7)}
+	world.Add(NewSphere(Point3{10, 30, 10}, 5, sun))
+	lights := HittableList{}
+	lights.Add(NewSphere(Point3{10, 30, 10}, 5, EmptyMaterial{}))
+
+	cam := DefaultCamera()
+	cam.aspectRadio = 3.0 / 2.0
+	cam.imageWidth = 600
+	cam.samplesPerPixel = 400
+	cam.maxDepth = 50
+	cam.background = RGB{0.05, 0.05, 0.1}
+
+	cam.lookfrom = Point3{0, 0.4, 0}
+	cam.lookat = Point3{0, 0.4, -1}
+	cam.vup = Vec3{0, 1, 0}
+	cam.focusDist = 2
+
+	lens := NewLensProjection(50, 1.8)
+	switch 1 {
+	case 1:
+		// Hexagonal bokeh, squeezed into cat's eyes toward the corners
+		lens.aperture = PolygonAperture{6, 15}
+		lens.catEye = 0.4
+	case 2:
+		// Shifted up to fit the buildings, keeping the camera level so they stay upright
+		lens.focalLength = 24
+		lens.fStop = 11
+		lens.shift = [2]float64{0, 8}
+		cam.focusDist = 11
+	case 3:
+		// Plane of focus tilted toward the ground, for a miniature look
+		lens.focalLength = 35
+		lens.fStop = 2.8
+		lens.tilt = [2]float64{-20, 0}
+		cam.lookfrom = Point3{0, 3, 2}
+		cam.lookat = Point3{0, 0, -8}
+		cam.focusDist = 8
+	}
+	cam.projection = lens
+
+	cam.Render(world, lights)
+}
+
+func main() {
+	scene := flag.Int("scene", 1, "scene to render, from 1 to 16, any other number rendering a quick final scene")
+	flag.StringVar(&CoordinatorAddress, "coordinator", "", "render with workers, serving them on this address, like :8600")
+	flag.StringVar(&CoordinatorURL, "worker", "", "render for the coordinator at this URL, like http://host:8600")
+	flag.BoolVar(&DenoiseImage, "denoise", false, "write a denoised image too, guided by the albedo and normal AOVs if the camera has them")
+	flag.Parse()
+
+	// Workers render the scene of their coordinator.
+	if CoordinatorURL != "" {
+		job, err := FetchJob(CoordinatorURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		WorkerJob = job
+		*scene = job.Scene
+	}
+	SceneNumber = *scene
+
+	RenderScene(*scene)
+}
+
+func RenderScene(scene int) {
+	switch scene {
+	case 1:
+		CornellBox()
+	case 2:
+		CornellSubsurface()
+	case 3:
+		BumpedSpheres()
+	case 4:
+		Earth()
+	case 5:
+		Fence()
+	case 6:
+		ProceduralSpheres()
+	case 7:
+		TextureNodes()
+	case 8:
+		Primitives()
+	case 9:
+		CornellCSG()
+	case 10:
+		DistanceFields()
+	case 11:
+		FinalScene(800, 10000, 40)
+	case 12:
+		Terrain()
+	case 13:
+		Forest()
+	case 14:
+		HairAndGrass()
+	case 15:
+		CameraModels()
+	case 16:
+		LensEffects()
+	default:
+		FinalScene(400, 250, 4)
+	}
+}
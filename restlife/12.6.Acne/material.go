@@ -1,12 +1,9 @@
 package main
 
-import (
-	"math"
-	"math/rand/v2"
-)
+import "math"
 
 type Material interface {
-	Scatter(in Ray, rec HitRecord) (bool, ScatterRecord)
+	Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord)
 	Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB
 	ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64
 }
@@ -20,7 +17,7 @@ type ScatterRecord struct {
 
 type EmptyMaterial struct{}
 
-func (m EmptyMaterial) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
+func (m EmptyMaterial) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
 	return false, ScatterRecord{skipPdf: true}
 }
 
@@ -36,8 +33,8 @@ type Lambertian struct {
 	tex Texture
 }
 
-func (m Lambertian) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
-	attenuation := m.tex.Value(rec.u, rec.v, rec.p)
+func (m Lambertian) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	attenuation := TextureValue(m.tex, rec)
 	pdf := NewCosinePDF(rec.normal)
 	skipPdf := false
 	return true, ScatterRecord{attenuation: attenuation, pdf: pdf, skipPdf: skipPdf}
@@ -61,9 +58,9 @@ type Metal struct {
 	fuzz   float64
 }
 
-func (m Metal) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
+func (m Metal) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
 	reflected := Reflect(in.dir, rec.normal)
-	reflected = reflected.Normalize().Add(RandomUnitVector().Muln(m.fuzz))
+	reflected = reflected.Normalize().Add(SampleUnitVector(s.Get2D()).Muln(m.fuzz))
 
 	attenuation := m.albedo
 	scattered := Ray{rec.p, reflected, in.tm}
@@ -84,7 +81,7 @@ type Dielectric struct {
 	refractionIndex float64
 }
 
-func (m Dielectric) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
+func (m Dielectric) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
 	attenuation := RGB{1, 1, 1}
 	ri := m.refractionIndex
 	if rec.frontFace {
@@ -97,7 +94,7 @@ func (m Dielectric) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
 
 	cannotRefract := ri*sinTheta > 1.0
 	var direction Vec3
-	if cannotRefract || Reflectance(cosTheta, ri) > rand.Float64() {
+	if cannotRefract || Reflectance(cosTheta, ri) > s.Get1D() {
 		direction = Reflect(unitDirection, rec.normal)
 	} else {
 		direction = Refract(unitDirection, rec.normal, ri)
@@ -130,10 +127,10 @@ func (m DiffuseLight) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB
 	if !rec.frontFace {
 		return RGB{}
 	}
-	return m.tex.Value(u, v, p)
+	return TextureValue(m.tex, rec)
 }
 
-func (m DiffuseLight) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
+func (m DiffuseLight) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
 	return false, ScatterRecord{}
 }
 
@@ -149,8 +146,8 @@ func (m Isotropic) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
 	return RGB{}
 }
 
-func (m Isotropic) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
-	attenuation := m.tex.Value(rec.u, rec.v, rec.p)
+func (m Isotropic) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	attenuation := TextureValue(m.tex, rec)
 	pdf := SpherePDF{}
 	return true, ScatterRecord{attenuation: attenuation, pdf: pdf, skipPdf: false}
 }
@@ -158,3 +155,214 @@ func (m Isotropic) Scatter(in Ray, rec HitRecord) (bool, ScatterRecord) {
 func (m Isotropic) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
 	return 1 / (4 * math.Pi)
 }
+
+type Hair struct {
+	// Kajiya-Kay style hair: a diffuse lobe following the sine of the angle to the hair, and a
+	// specular cone around it mirroring the incoming direction. The hair runs along dpdu.
+	tex       Texture
+	specular  float64 // Share of the specular lobe, from 0 to 1
+	roughness float64 // Spread of the specular cone, about 0.05 for shiny hair
+}
+
+func (m Hair) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	attenuation := TextureValue(m.tex, rec)
+	pdf := NewHairPDF(m.Tangent(rec), in.dir, m.specular, m.roughness)
+	return true, ScatterRecord{attenuation: attenuation, pdf: pdf, skipPdf: false}
+}
+
+func (m Hair) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
+	return RGB{}
+}
+
+func (m Hair) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
+	// Hair is thin enough to scatter light all around it, so this is a density over the
+	// whole sphere of directions, the one Scatter samples.
+	return NewHairPDF(m.Tangent(rec), in.dir, m.specular, m.roughness).Value(scattered.dir)
+}
+
+func (m Hair) Tangent(rec HitRecord) Vec3 {
+	if rec.dpdu.NearZero() {
+		return NewONB(rec.normal).U()
+	}
+	return rec.dpdu
+}
+
+type SubsurfaceInterface struct {
+	// Refractive index of the translucent volume, and the path weight carried by rays that
+	// leave the volume through this surface point.
+	refractionIndex float64
+	weight          RGB
+}
+
+func (m SubsurfaceInterface) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	ri := m.refractionIndex
+	if rec.frontFace {
+		ri = 1 / m.refractionIndex
+	}
+
+	unitDirection := in.dir.Normalize()
+	cosTheta := math.Min(unitDirection.Muln(-1).Dot(rec.normal), 1)
+	sinTheta := math.Sqrt(1 - cosTheta*cosTheta)
+
+	cannotRefract := ri*sinTheta > 1.0
+	var direction Vec3
+	if cannotRefract || Reflectance(cosTheta, ri) > s.Get1D() {
+		direction = Reflect(unitDirection, rec.normal)
+	} else {
+		direction = Refract(unitDirection, rec.normal, ri)
+	}
+
+	scattered := Ray{rec.p, direction, in.tm}
+	return true, ScatterRecord{attenuation: m.weight, skipPdfRay: scattered, skipPdf: true}
+}
+
+func (m SubsurfaceInterface) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
+	return RGB{}
+}
+
+func (m SubsurfaceInterface) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
+	return 0
+}
+
+type SubsurfacePhase struct {
+	weight RGB
+}
+
+func (m SubsurfacePhase) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	// Light sources can't be seen from inside the volume, so the isotropic phase function is
+	// sampled directly instead of being mixed with the lights.
+	scattered := Ray{rec.p, SampleUnitVector(s.Get2D()), in.tm}
+	return true, ScatterRecord{attenuation: m.weight, skipPdfRay: scattered, skipPdf: true}
+}
+
+func (m SubsurfacePhase) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
+	return RGB{}
+}
+
+func (m SubsurfacePhase) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
+	return 1 / (4 * math.Pi)
+}
+
+type BumpMap struct {
+	// Wraps a material and perturbs its shading normal by the gradient of a height texture.
+	material Material
+	height   Texture
+	scale    float64
+}
+
+func (m BumpMap) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	rec = m.Perturb(rec)
+	ok, srec := m.material.Scatter(in, rec, s)
+	if ok && srec.skipPdf && !ConsistentNormals(rec, srec.skipPdfRay.dir) {
+		return false, ScatterRecord{}
+	}
+	return ok, srec
+}
+
+func (m BumpMap) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
+	return m.material.Emitted(in, m.Perturb(rec), u, v, p)
+}
+
+func (m BumpMap) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
+	rec = m.Perturb(rec)
+	if !ConsistentNormals(rec, scattered.dir) {
+		return 0
+	}
+	return m.material.ScatteringPdf(in, rec, scattered)
+}
+
+func (m BumpMap) Perturb(rec HitRecord) HitRecord {
+	// Displace the surface along its normal by the height texture and rebuild the shading
+	// normal from the displaced partial derivatives, using forward differences in u and v.
+	if rec.dpdu.NearZero() || rec.dpdv.NearZero() {
+		return rec
+	}
+
+	du, dv := 0.0005, 0.0005
+	displace := m.Displacement(rec.u, rec.v, rec.p)
+	uDisplace := m.Displacement(rec.u+du, rec.v, rec.p.Add(rec.dpdu.Muln(du)))
+	vDisplace := m.Displacement(rec.u, rec.v+dv, rec.p.Add(rec.dpdv.Muln(dv)))
+
+	dpdu := rec.dpdu.Add(rec.normal.Muln((uDisplace - displace) / du))
+	dpdv := rec.dpdv.Add(rec.normal.Muln((vDisplace - displace) / dv))
+
+	shadingNormal := dpdu.Cross(dpdv)
+	if shadingNormal.NearZero() {
+		return rec
+	}
+	shadingNormal = shadingNormal.Normalize()
+	if shadingNormal.Dot(rec.normal) < 0 {
+		shadingNormal = shadingNormal.Muln(-1)
+	}
+
+	rec.normal = shadingNormal
+	rec.dpdu = dpdu
+	rec.dpdv = dpdv
+	return rec
+}
+
+func (m BumpMap) Displacement(u, v float64, p Point3) float64 {
+	return m.scale * m.height.Value(u, v, p).Average()
+}
+
+type NormalMap struct {
+	// Wraps a material and replaces its shading normal by a tangent space normal read from a
+	// texture, with each color channel in [0,1] mapped to a vector component in [-1,1].
+	material Material
+	normals  Texture
+}
+
+func (m NormalMap) Scatter(in Ray, rec HitRecord, s Sampler) (bool, ScatterRecord) {
+	rec = m.Perturb(rec)
+	ok, srec := m.material.Scatter(in, rec, s)
+	if ok && srec.skipPdf && !ConsistentNormals(rec, srec.skipPdfRay.dir) {
+		return false, ScatterRecord{}
+	}
+	return ok, srec
+}
+
+func (m NormalMap) Emitted(in Ray, rec HitRecord, u, v float64, p Point3) RGB {
+	return m.material.Emitted(in, m.Perturb(rec), u, v, p)
+}
+
+func (m NormalMap) ScatteringPdf(in Ray, rec HitRecord, scattered Ray) float64 {
+	rec = m.Perturb(rec)
+	if !ConsistentNormals(rec, scattered.dir) {
+		return 0
+	}
+	return m.material.ScatteringPdf(in, rec, scattered)
+}
+
+func (m NormalMap) Perturb(rec HitRecord) HitRecord {
+	if rec.dpdu.NearZero() {
+		return rec
+	}
+
+	// Build the tangent frame, with the tangent made orthogonal to the normal and the
+	// bitangent following the direction of increasing v.
+	n := rec.normal
+	t := rec.dpdu.Sub(n.Muln(n.Dot(rec.dpdu)))
+	if t.NearZero() {
+		return rec
+	}
+	t = t.Normalize()
+	b := n.Cross(t)
+	if b.Dot(rec.dpdv) < 0 {
+		b = b.Muln(-1)
+	}
+
+	local := m.normals.Value(rec.u, rec.v, rec.p).Muln(2).Sub(Vec3{1, 1, 1})
+	shadingNormal := t.Muln(local.X()).Add(b.Muln(local.Y())).Add(n.Muln(local.Z()))
+	if shadingNormal.NearZero() {
+		return rec
+	}
+
+	rec.normal = shadingNormal.Normalize()
+	return rec
+}
+
+func ConsistentNormals(rec HitRecord, direction Vec3) bool {
+	// A perturbed shading normal can tilt a scattered direction across the actual surface,
+	// which leaks light through it. Only accept directions on the same side of both normals.
+	return (direction.Dot(rec.normal) > 0) == (direction.Dot(rec.geomNormal) > 0)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Approximate memory taken by one tessellated triangle, including its share of the BVH.
+const MeshTriangleBytes = int(unsafe.Sizeof(MeshTriangle{}) + unsafe.Sizeof(BVHNode{}) + unsafe.Sizeof(Hittable(nil)))
+
+type Mesh struct {
+	positions []Point3
+	uvs       [][2]float64 // Per vertex texture coordinates, or empty
+	faces     [][]int      // Vertex indices of each face, counter-clockwise seen from outside
+}
+
+func NewMesh(positions []Point3, uvs [][2]float64, faces [][]int) Mesh {
+	return Mesh{positions, uvs, faces}
+}
+
+func NewGridMesh(corner Point3, u, v Vec3, nu, nv int) Mesh {
+	// A grid of nu by nv quads spanning the parallelogram from corner, with UVs from 0 to 1.
+	mesh := Mesh{}
+	for j := range nv + 1 {
+		for i := range nu + 1 {
+			a, b := float64(i)/float64(nu), float64(j)/float64(nv)
+			mesh.positions = append(mesh.positions, corner.Add(u.Muln(a)).Add(v.Muln(b)))
+			mesh.uvs = append(mesh.uvs, [2]float64{a, b})
+		}
+	}
+	for j := range nv {
+		for i := range nu {
+			k := j*(nu+1) + i
+			mesh.faces = append(mesh.faces, []int{k, k + 1, k + nu + 2, k + nu + 1})
+		}
+	}
+	return mesh
+}
+
+type MeshEdge [2]int
+
+func NewMeshEdge(a, b int) MeshEdge {
+	// Edges are undirected, so the smaller vertex index always comes first.
+	if a > b {
+		a, b = b, a
+	}
+	return MeshEdge{a, b}
+}
+
+type MeshTopology struct {
+	edges       []MeshEdge         // Every edge once, in the order the faces first use them
+	edgeFaces   map[MeshEdge][]int // Faces on each side of an edge, one for boundary edges
+	vertexFaces [][]int            // Faces around each vertex
+	neighbors   [][]int            // Vertices sharing an edge with each vertex
+}
+
+func (mesh Mesh) Topology() MeshTopology {
+	topo := MeshTopology{
+		edgeFaces:   map[MeshEdge][]int{},
+		vertexFaces: make([][]int, len(mesh.positions)),
+		neighbors:   make([][]int, len(mesh.positions)),
+	}
+	for f, face := range mesh.faces {
+		for i, a := range face {
+			b := face[(i+1)%len(face)]
+			e := NewMeshEdge(a, b)
+			if _, ok := topo.edgeFaces[e]; !ok {
+				topo.edges = append(topo.edges, e)
+				topo.neighbors[a] = append(topo.neighbors[a], b)
+				topo.neighbors[b] = append(topo.neighbors[b], a)
+			}
+			topo.edgeFaces[e] = append(topo.edgeFaces[e], f)
+			topo.vertexFaces[a] = append(topo.vertexFaces[a], f)
+		}
+	}
+	return topo
+}
+
+func (topo MeshTopology) BoundaryNeighbors(i int) []int {
+	// Returns the neighbors of vertex i across boundary edges, two when i is on a boundary.
+	var boundary []int
+	for _, j := range topo.neighbors[i] {
+		if len(topo.edgeFaces[NewMeshEdge(i, j)]) == 1 {
+			boundary = append(boundary, j)
+		}
+	}
+	return boundary
+}
+
+func (mesh Mesh) BoundaryVertex(topo MeshTopology, i int) (Point3, bool) {
+	// Boundary vertices follow the cubic B-spline of the boundary curve, except for corners
+	// where the boundary turns sharply, which stay put so open meshes keep their outline.
+	boundary := topo.BoundaryNeighbors(i)
+	if len(boundary) == 0 {
+		return Point3{}, false
+	}
+	p := mesh.positions[i]
+	if len(boundary) != 2 {
+		return p, true
+	}
+	a, b := mesh.positions[boundary[0]], mesh.positions[boundary[1]]
+	if a.Sub(p).Normalize().Dot(b.Sub(p).Normalize()) > -0.9 {
+		return p, true
+	}
+	return p.Muln(0.75).Add(a.Add(b).Muln(0.125)), true
+}
+
+func (mesh Mesh) EdgeUV(e MeshEdge) [2]float64 {
+	a, b := mesh.uvs[e[0]], mesh.uvs[e[1]]
+	return [2]float64{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2}
+}
+
+func (mesh Mesh) IsTriangular() bool {
+	for _, face := range mesh.faces {
+		if len(face) != 3 {
+			return false
+		}
+	}
+	return true
+}
+
+func (mesh Mesh) Subdivide() Mesh {
+	// Triangle meshes use Loop subdivision, anything else Catmull-Clark.
+	if mesh.IsTriangular() {
+		return mesh.LoopSubdivide()
+	}
+	return mesh.CatmullClark()
+}
+
+func (mesh Mesh) LoopSubdivide() Mesh {
+	// Splits every triangle into four, and smooths the vertices toward the limit surface.
+	// Texture coordinates are interpolated linearly so seams don't drift.
+	topo := mesh.Topology()
+	n := len(mesh.positions)
+	hasUVs := len(mesh.uvs) == n
+	result := Mesh{positions: make([]Point3, n, n+len(topo.edges))}
+	if hasUVs {
+		result.uvs = make([][2]float64, n, n+len(topo.edges))
+		copy(result.uvs, mesh.uvs)
+	}
+
+	// Move the original vertices.
+	for i, p := range mesh.positions {
+		if q, ok := mesh.BoundaryVertex(topo, i); ok {
+			result.positions[i] = q
+			continue
+		}
+		valence := float64(len(topo.neighbors[i]))
+		beta := 3.0 / 16
+		if valence > 3 {
+			beta = 3 / (8 * valence)
+		}
+		sum := Vec3{}
+		for _, j := range topo.neighbors[i] {
+			sum = sum.Add(mesh.positions[j])
+		}
+		result.positions[i] = p.Muln(1 - valence*beta).Add(sum.Muln(beta))
+	}
+
+	// Add a vertex on every edge.
+	edgeVertex := make(map[MeshEdge]int, len(topo.edges))
+	for _, e := range topo.edges {
+		a, b := mesh.positions[e[0]], mesh.positions[e[1]]
+		p := a.Add(b).Muln(0.5)
+		if faces := topo.edgeFaces[e]; len(faces) == 2 {
+			opposite := Vec3{}
+			for _, f := range faces {
+				for _, k := range mesh.faces[f] {
+					if k != e[0] && k != e[1] {
+						opposite = opposite.Add(mesh.positions[k])
+					}
+				}
+			}
+			p = a.Add(b).Muln(0.375).Add(opposite.Muln(0.125))
+		}
+		edgeVertex[e] = len(result.positions)
+		result.positions = append(result.positions, p)
+		if hasUVs {
+			result.uvs = append(result.uvs, mesh.EdgeUV(e))
+		}
+	}
+
+	for _, face := range mesh.faces {
+		a, b, c := face[0], face[1], face[2]
+		ab, bc, ca := edgeVertex[NewMeshEdge(a, b)], edgeVertex[NewMeshEdge(b, c)], edgeVertex[NewMeshEdge(c, a)]
+		result.faces = append(result.faces, []int{a, ab, ca}, []int{ab, b, bc}, []int{ca, bc, c}, []int{ab, bc, ca})
+	}
+	return result
+}
+
+func (mesh Mesh) CatmullClark() Mesh {
+	// Splits every face with k sides into k quads around a new face vertex, and smooths the
+	// vertices toward the limit surface. The result is always a quad mesh.
+	topo := mesh.Topology()
+	n := len(mesh.positions)
+	hasUVs := len(mesh.uvs) == n
+	result := Mesh{positions: make([]Point3, n, n+len(mesh.faces)+len(topo.edges))}
+	if hasUVs {
+		result.uvs = make([][2]float64, n, cap(result.positions))
+		copy(result.uvs, mesh.uvs)
+	}
+
+	// Add a vertex at the centroid of every face.
+	facePoints := make([]Point3, len(mesh.faces))
+	for f, face := range mesh.faces {
+		sum, uv := Vec3{}, [2]float64{}
+		for _, k := range face {
+			sum = sum.Add(mesh.positions[k])
+			if hasUVs {
+				uv[0] += mesh.uvs[k][0] / float64(len(face))
+				uv[1] += mesh.uvs[k][1] / float64(len(face))
+			}
+		}
+		facePoints[f] = sum.Divn(float64(len(face)))
+		result.positions = append(result.positions, facePoints[f])
+		if hasUVs {
+			result.uvs = append(result.uvs, uv)
+		}
+	}
+
+	// Add a vertex on every edge, averaging its ends with the neighboring face points.
+	edgeVertex := make(map[MeshEdge]int, len(topo.edges))
+	for _, e := range topo.edges {
+		p := mesh.positions[e[0]].Add(mesh.positions[e[1]]).Muln(0.5)
+		if faces := topo.edgeFaces[e]; len(faces) == 2 {
+			p = p.Add(facePoints[faces[0]].Add(facePoints[faces[1]]).Muln(0.5)).Muln(0.5)
+		}
+		edgeVertex[e] = len(result.positions)
+		result.positions = append(result.positions, p)
+		if hasUVs {
+			result.uvs = append(result.uvs, mesh.EdgeUV(e))
+		}
+	}
+
+	// Move the original vertices.
+	for i, p := range mesh.positions {
+		if q, ok := mesh.BoundaryVertex(topo, i); ok {
+			result.positions[i] = q
+			continue
+		}
+		valence := float64(len(topo.neighbors[i]))
+		faceAverage := Vec3{}
+		for _, f := range topo.vertexFaces[i] {
+			faceAverage = faceAverage.Add(facePoints[f])
+		}
+		faceAverage = faceAverage.Divn(float64(len(topo.vertexFaces[i])))
+		edgeAverage := Vec3{}
+		for _, j := range topo.neighbors[i] {
+			edgeAverage = edgeAverage.Add(p.Add(mesh.positions[j]).Muln(0.5))
+		}
+		edgeAverage = edgeAverage.Divn(valence)
+		result.positions[i] = faceAverage.Add(edgeAverage.Muln(2)).Add(p.Muln(valence - 3)).Divn(valence)
+	}
+
+	for f, face := range mesh.faces {
+		for i, k := range face {
+			next := edgeVertex[NewMeshEdge(k, face[(i+1)%len(face)])]
+			prev := edgeVertex[NewMeshEdge(face[(i+len(face)-1)%len(face)], k)]
+			result.faces = append(result.faces, []int{k, next, n + f, prev})
+		}
+	}
+	return result
+}
+
+func (mesh Mesh) TriangleCount() int {
+	count := 0
+	for _, face := range mesh.faces {
+		count += len(face) - 2
+	}
+	return count
+}
+
+func (mesh Mesh) SubdividedTriangleCount() int {
+	// Number of triangles after one more subdivision step.
+	if mesh.IsTriangular() {
+		return 4 * len(mesh.faces)
+	}
+	count := 0
+	for _, face := range mesh.faces {
+		count += 2 * len(face)
+	}
+	return count
+}
+
+func (mesh Mesh) Refine(levels, memoryBudget int) Mesh {
+	// Subdivides up to levels times, stopping early when the tessellated triangles would take
+	// more than memoryBudget bytes. A budget of zero means no limit.
+	for range levels {
+		if memoryBudget > 0 && mesh.SubdividedTriangleCount()*MeshTriangleBytes > memoryBudget {
+			break
+		}
+		mesh = mesh.Subdivide()
+	}
+	return mesh
+}
+
+func (mesh Mesh) Normals() []Vec3 {
+	// Vertex normals are the area weighted average of the normals of the faces around them.
+	normals := make([]Vec3, len(mesh.positions))
+	for _, face := range mesh.faces {
+		p0 := mesh.positions[face[0]]
+		n := Vec3{}
+		for i := 1; i+1 < len(face); i++ {
+			n = n.Add(mesh.positions[face[i]].Sub(p0).Cross(mesh.positions[face[i+1]].Sub(p0)))
+		}
+		for _, k := range face {
+			normals[k] = normals[k].Add(n)
+		}
+	}
+	for i, n := range normals {
+		if !n.NearZero() {
+			normals[i] = n.Normalize()
+		}
+	}
+	return normals
+}
+
+func (mesh Mesh) Displace(height Texture, scale float64) Mesh {
+	// Moves every vertex along its normal by the average of the height texture, times scale.
+	normals := mesh.Normals()
+	result := Mesh{make([]Point3, len(mesh.positions)), mesh.uvs, mesh.faces}
+	for i, p := range mesh.positions {
+		var u, v float64
+		if len(mesh.uvs) == len(mesh.positions) {
+			u, v = mesh.uvs[i][0], mesh.uvs[i][1]
+		}
+		h := height.Value(u, v, p).Average()
+		result.positions[i] = p.Add(normals[i].Muln(h * scale))
+	}
+	return result
+}
+
+func (mesh Mesh) Tessellate(mat Material) HittableList {
+	// Splits the faces into smooth shaded triangles.
+	normals := mesh.Normals()
+	hasUVs := len(mesh.uvs) == len(mesh.positions)
+	list := HittableList{}
+	for _, face := range mesh.faces {
+		for i := 1; i+1 < len(face); i++ {
+			k := [3]int{face[0], face[i], face[i+1]}
+			var tri MeshTriangle
+			for j := range 3 {
+				tri.p[j], tri.n[j] = mesh.positions[k[j]], normals[k[j]]
+				if hasUVs {
+					tri.uv[j] = mesh.uvs[k[j]]
+				}
+			}
+			if tri.p[1].Sub(tri.p[0]).Cross(tri.p[2].Sub(tri.p[0])).NearZero() {
+				continue
+			}
+			list.Add(NewMeshTriangle(tri.p, tri.n, tri.uv, mat))
+		}
+	}
+	return list
+}
+
+func NewDisplacedMesh(mesh Mesh, levels int, height Texture, scale float64, memoryBudget int, mat Material) BVHNode {
+	// Subdivides the mesh within the memory budget, displaces it by the height texture and
+	// builds a BVH over the resulting triangles.
+	if height != nil {
+		mesh = mesh.Refine(levels, memoryBudget).Displace(height, scale)
+	} else {
+		mesh = mesh.Refine(levels, memoryBudget)
+	}
+	return NewBVHNode(mesh.Tessellate(mat))
+}
+
+type MeshTriangle struct {
+	p          [3]Point3
+	n          [3]Vec3 // Vertex normals, interpolated for shading
+	uv         [3][2]float64
+	mat        Material
+	bbox       AABB
+	normal     Vec3 // Geometric normal
+	dpdu, dpdv Vec3
+	area       float64
+}
+
+func NewMeshTriangle(p [3]Point3, n [3]Vec3, uv [3][2]float64, mat Material) MeshTriangle {
+	cross := p[1].Sub(p[0]).Cross(p[2].Sub(p[0]))
+	tri := MeshTriangle{p: p, n: n, uv: uv, mat: mat, normal: cross.Normalize(), area: cross.Length() / 2}
+	tri.bbox = NewAABBBox(NewAABBPoint(p[0], p[1]), NewAABBPoint(p[0], p[2]))
+	tri.dpdu, tri.dpdv = GetTriangleTangents(p[0], p[1], p[2], uv[0], uv[1], uv[2])
+	return tri
+}
+
+func IntersectTriangle(r Ray, p0, p1, p2 Point3, intvl Interval) (bool, float64, float64, float64) {
+	// Möller-Trumbore intersection, solving for t and the barycentric coordinates of p1 and p2
+	// at once.
+	e1, e2 := p1.Sub(p0), p2.Sub(p0)
+	pvec := r.dir.Cross(e2)
+	det := e1.Dot(pvec)
+	if math.Abs(det) < 1e-12 {
+		return false, 0, 0, 0
+	}
+	invDet := 1 / det
+
+	tvec := r.orig.Sub(p0)
+	b1 := tvec.Dot(pvec) * invDet
+	if b1 < 0 || b1 > 1 {
+		return false, 0, 0, 0
+	}
+	qvec := tvec.Cross(e1)
+	b2 := r.dir.Dot(qvec) * invDet
+	if b2 < 0 || b1+b2 > 1 {
+		return false, 0, 0, 0
+	}
+	t := e2.Dot(qvec) * invDet
+	if !intvl.Contains(t) {
+		return false, 0, 0, 0
+	}
+	return true, t, b1, b2
+}
+
+func (hit MeshTriangle) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	ok, t, b1, b2 := IntersectTriangle(r, hit.p[0], hit.p[1], hit.p[2], intvl)
+	if !ok {
+		return false, HitRecord{}
+	}
+
+	b0 := 1 - b1 - b2
+	rec := HitRecord{}
+	rec.t = t
+	rec.p = r.At(t)
+	rec.u = b0*hit.uv[0][0] + b1*hit.uv[1][0] + b2*hit.uv[2][0]
+	rec.v = b0*hit.uv[0][1] + b1*hit.uv[1][1] + b2*hit.uv[2][1]
+	rec.mat = hit.mat
+	rec.SetFaceNormal(r, hit.normal)
+	rec.objectP, rec.objectNormal = rec.p, hit.normal
+	rec.dpdu, rec.dpdv = hit.dpdu, hit.dpdv
+
+	// Shade with the interpolated vertex normal, kept on the side of the geometric one.
+	shading := hit.n[0].Muln(b0).Add(hit.n[1].Muln(b1)).Add(hit.n[2].Muln(b2))
+	if !shading.NearZero() {
+		shading = shading.Normalize()
+		if shading.Dot(rec.geomNormal) < 0 {
+			shading = shading.Muln(-1)
+		}
+		rec.normal = shading
+	}
+
+	return true, rec
+}
+
+func (hit MeshTriangle) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit MeshTriangle) PDFValue(origin Point3, direction Vec3) float64 {
+	return AreaPDFValue(hit, hit.area, origin, direction)
+}
+
+func (hit MeshTriangle) Random(origin Point3, s Sampler) Vec3 {
+	a, b := s.Get2D()
+	if a+b > 1 {
+		a, b = 1-a, 1-b
+	}
+	p := hit.p[0].Add(hit.p[1].Sub(hit.p[0]).Muln(a)).Add(hit.p[2].Sub(hit.p[0]).Muln(b))
+	return p.Sub(origin)
+}
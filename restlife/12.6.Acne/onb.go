@@ -32,3 +32,8 @@ func (onb ONB) Transform(v Vec3) Vec3 {
 	// Transform from basis coordinates to local space.
 	return onb[0].Muln(v[0]).Add(onb[1].Muln(v[1])).Add(onb[2].Muln(v[2]))
 }
+
+func (onb ONB) ToLocal(v Vec3) Vec3 {
+	// Transform from local space to basis coordinates.
+	return Vec3{v.Dot(onb[0]), v.Dot(onb[1]), v.Dot(onb[2])}
+}
@@ -1,13 +1,10 @@
 package main
 
-import (
-	"math"
-	"math/rand/v2"
-)
+import "math"
 
 type PDF interface {
 	Value(direction Vec3) float64
-	Generate() Vec3
+	Generate(s Sampler) Vec3
 }
 
 type EmptyPDF struct{}
@@ -16,7 +13,7 @@ func (pdf EmptyPDF) Value(direction Vec3) float64 {
 	return 0
 }
 
-func (pdf EmptyPDF) Generate() Vec3 {
+func (pdf EmptyPDF) Generate(s Sampler) Vec3 {
 	return Vec3{}
 }
 
@@ -26,8 +23,8 @@ func (pdf SpherePDF) Value(direction Vec3) float64 {
 	return 1 / (4 * math.Pi)
 }
 
-func (pdf SpherePDF) Generate() Vec3 {
-	return RandomUnitVector()
+func (pdf SpherePDF) Generate(s Sampler) Vec3 {
+	return SampleUnitVector(s.Get2D())
 }
 
 type CosinePDF struct {
@@ -43,8 +40,8 @@ func (pdf CosinePDF) Value(direction Vec3) float64 {
 	return math.Max(0, cosineTheta/math.Pi)
 }
 
-func (pdf CosinePDF) Generate() Vec3 {
-	return pdf.uvw.Transform(RandomCosineDirection())
+func (pdf CosinePDF) Generate(s Sampler) Vec3 {
+	return pdf.uvw.Transform(SampleCosineDirection(s.Get2D()))
 }
 
 type HittablePDF struct {
@@ -56,8 +53,8 @@ func (pdf HittablePDF) Value(direction Vec3) float64 {
 	return pdf.objects.PDFValue(pdf.origin, direction)
 }
 
-func (pdf HittablePDF) Generate() Vec3 {
-	return pdf.objects.Random(pdf.origin)
+func (pdf HittablePDF) Generate(s Sampler) Vec3 {
+	return pdf.objects.Random(pdf.origin, s)
 }
 
 type MixturePDF [2]PDF
@@ -66,10 +63,72 @@ func (pdf MixturePDF) Value(direction Vec3) float64 {
 	return 0.5*pdf[0].Value(direction) + 0.5*pdf[1].Value(direction)
 }
 
-func (pdf MixturePDF) Generate() Vec3 {
-	if rand.Float64() < 0.5 {
-		return pdf[0].Generate()
+func (pdf MixturePDF) Generate(s Sampler) Vec3 {
+	if s.Get1D() < 0.5 {
+		return pdf[0].Generate(s)
 	} else {
-		return pdf[1].Generate()
+		return pdf[1].Generate(s)
 	}
 }
+
+type HairPDF struct {
+	// Mixture of the diffuse and specular lobes of Kajiya-Kay style hair scattering, around
+	// the hair tangent. Directions are described by z, the cosine of their angle to the
+	// tangent, and their azimuth around it.
+	tangent   Vec3
+	uvw       ONB
+	specular  float64 // Weight of the specular lobe
+	zr        float64 // Cosine of the specular cone, mirroring the incoming direction
+	roughness float64 // Width of the specular lobe around the cone, in units of z
+}
+
+func NewHairPDF(tangent, incoming Vec3, specular, roughness float64) HairPDF {
+	t := tangent.Normalize()
+	return HairPDF{t, NewONB(t), specular, t.Dot(incoming.Normalize()), roughness}
+}
+
+func (pdf HairPDF) Value(direction Vec3) float64 {
+	// The diffuse lobe follows the sine of the angle to the tangent, which integrates to pi^2
+	// over the sphere. The specular lobe decays exponentially away from the cone in z, and
+	// is uniform in azimuth.
+	z := Clamp(pdf.tangent.Dot(direction.Normalize()), -1, 1)
+	diffuse := math.Sqrt(1-z*z) / (math.Pi * math.Pi)
+	below, above := pdf.LobeMasses()
+	specular := math.Exp(-math.Abs(z-pdf.zr)/pdf.roughness) / (below + above) / (2 * math.Pi)
+	return (1-pdf.specular)*diffuse + pdf.specular*specular
+}
+
+func (pdf HairPDF) LobeMasses() (float64, float64) {
+	// Integrals of the specular lobe over z below and above the cone.
+	s := pdf.roughness
+	return s * (1 - math.Exp(-(1+pdf.zr)/s)), s * (1 - math.Exp(-(1-pdf.zr)/s))
+}
+
+func (pdf HairPDF) Generate(s Sampler) Vec3 {
+	// One dimension picks the lobe, and is reused within it, two more place the direction.
+	choice := s.Get1D()
+	r1, r2 := s.Get2D()
+	if choice >= pdf.specular {
+		// The sine of the angle to the tangent is the height of a semicircle, which is the
+		// density of one coordinate of the points of a disk.
+		z := SampleUnitDisk(r1, r2).X()
+		r := math.Sqrt(1 - z*z)
+		phi := 2 * math.Pi * (choice - pdf.specular) / (1 - pdf.specular)
+		return pdf.uvw.Transform(Vec3{r * math.Cos(phi), r * math.Sin(phi), z})
+	}
+
+	// Pick the side of the cone by its share of the lobe, then invert the truncated
+	// exponential on that side.
+	w := pdf.roughness
+	below, above := pdf.LobeMasses()
+	var z float64
+	if choice/pdf.specular*(below+above) < below {
+		z = pdf.zr + w*math.Log(1-r1*(1-math.Exp(-(1+pdf.zr)/w)))
+	} else {
+		z = pdf.zr - w*math.Log(1-r1*(1-math.Exp(-(1-pdf.zr)/w)))
+	}
+	z = Clamp(z, -1, 1)
+	r := math.Sqrt(1 - z*z)
+	phi := 2 * math.Pi * r2
+	return pdf.uvw.Transform(Vec3{r * math.Cos(phi), r * math.Sin(phi), z})
+}
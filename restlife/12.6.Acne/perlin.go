@@ -2,30 +2,83 @@ package main
 
 import (
 	"math"
+	"math/rand/v2"
 )
 
 const PointCount = 256
 
 type Perlin struct {
-	randvec [PointCount]Vec3
-	permX   [PointCount]int
-	permY   [PointCount]int
-	permZ   [PointCount]int
+	randvec  [PointCount]Vec3
+	randvec4 [PointCount][4]float64 // Gradients for the 4D noise
+	randpos  [PointCount]Vec3       // Feature point offsets within a unit cell, for Worley noise
+	permX    [PointCount]int
+	permY    [PointCount]int
+	permZ    [PointCount]int
+	permW    [PointCount]int
+	period   int // Lattice period the noise repeats after, or 0 for no repetition
 }
 
 func NewPerlin() Perlin {
+	// Seeds from the global random source, so every call gives different noise.
+	return NewPerlinRand(rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+}
+
+func NewPerlinSeeded(seed uint64) Perlin {
+	// The same seed always gives the same noise, so renders can be reproduced.
+	return NewPerlinRand(rand.New(rand.NewPCG(seed, 0)))
+}
+
+func NewPerlinPeriodic(seed uint64, period int) Perlin {
+	// Seeded noise repeating every period lattice units, or never when the period is 0.
+	perlin := NewPerlinSeeded(seed)
+	perlin.SetPeriod(period)
+	return perlin
+}
+
+func NewPerlinRand(rng *rand.Rand) Perlin {
 	perlin := Perlin{}
 	for i := range PointCount {
-		perlin.randvec[i] = RandomVec3Range(-1, 1).Normalize()
+		perlin.randvec[i] = Vec3{2*rng.Float64() - 1, 2*rng.Float64() - 1, 2*rng.Float64() - 1}.Normalize()
+		perlin.randpos[i] = Vec3{rng.Float64(), rng.Float64(), rng.Float64()}
+
+		g := [4]float64{}
+		norm := 0.0
+		for n := range g {
+			g[n] = 2*rng.Float64() - 1
+			norm += g[n] * g[n]
+		}
+		for n := range g {
+			g[n] /= math.Sqrt(norm)
+		}
+		perlin.randvec4[i] = g
 	}
 
-	PerlinGeneratePerm(perlin.permX[:])
-	PerlinGeneratePerm(perlin.permY[:])
-	PerlinGeneratePerm(perlin.permZ[:])
+	PerlinGeneratePerm(rng, perlin.permX[:])
+	PerlinGeneratePerm(rng, perlin.permY[:])
+	PerlinGeneratePerm(rng, perlin.permZ[:])
+	PerlinGeneratePerm(rng, perlin.permW[:])
 
 	return perlin
 }
 
+func (pl *Perlin) SetPeriod(period int) {
+	// Makes Noise, Noise4 and Worley repeat every period units along each axis, so textures
+	// tile seamlessly. Octaves that double the frequency keep tiling with the same period.
+	// Simplex doesn't follow it, its skewed lattice having no period along the axes.
+	pl.period = period
+}
+
+func (pl Perlin) Lattice(i int) int {
+	// Wraps a lattice coordinate to the period, then to the permutation table size.
+	if pl.period > 0 {
+		i %= pl.period
+		if i < 0 {
+			i += pl.period
+		}
+	}
+	return i & 255
+}
+
 func (pl Perlin) Noise(p Point3) float64 {
 	u := p.X() - math.Floor(p.X())
 	v := p.Y() - math.Floor(p.Y())
@@ -39,9 +92,9 @@ func (pl Perlin) Noise(p Point3) float64 {
 	for di := range 2 {
 		for dj := range 2 {
 			for dk := range 2 {
-				c[di][dj][dk] = pl.randvec[pl.permX[(i+di)&255]^
-					pl.permY[(j+dj)&255]^
-					pl.permZ[(k+dk)&255]]
+				c[di][dj][dk] = pl.randvec[pl.permX[pl.Lattice(i+di)]^
+					pl.permY[pl.Lattice(j+dj)]^
+					pl.permZ[pl.Lattice(k+dk)]]
 			}
 		}
 	}
@@ -63,16 +116,206 @@ func (pl Perlin) Turb(p Point3, depth int) float64 {
 	return math.Abs(accum)
 }
 
-func PerlinGeneratePerm(p []int) {
+func (pl Perlin) Fbm(p Point3, octaves int, lacunarity, gain float64) float64 {
+	// Fractional Brownian motion: octaves of noise, each one lacunarity times higher in
+	// frequency and gain times lower in amplitude than the previous one. Unlike Turb the
+	// signed sum is returned, normalized to roughly [-1,1].
+	accum := 0.0
+	norm := 0.0
+	tempP := p
+	weight := 1.0
+
+	for range octaves {
+		accum += weight * pl.Noise(tempP)
+		norm += weight
+		weight *= gain
+		tempP = tempP.Muln(lacunarity)
+	}
+
+	if norm == 0 {
+		return 0
+	}
+	return accum / norm
+}
+
+func (pl Perlin) Ridged(p Point3, octaves int, lacunarity, gain, offset float64) float64 {
+	// Ridged multifractal: the folded noise offset-|n| is squared into sharp crests, and each
+	// octave is weighted by the previous one so detail gathers along the ridges. The result is
+	// normalized to roughly [0,1].
+	accum := 0.0
+	norm := 0.0
+	tempP := p
+	weight := 1.0
+	amplitude := 1.0
+
+	for range octaves {
+		signal := offset - math.Abs(pl.Noise(tempP))
+		signal *= signal * weight
+		accum += amplitude * signal
+		norm += amplitude * offset * offset
+
+		weight = Clamp(signal, 0, 1)
+		amplitude *= gain
+		tempP = tempP.Muln(lacunarity)
+	}
+
+	if norm == 0 {
+		return 0
+	}
+	return accum / norm
+}
+
+func (pl Perlin) Worley(p Point3) (float64, float64) {
+	// Cellular noise: every unit cell holds one feature point, returns the distances from p to
+	// the closest and second closest feature points.
+	i := int(math.Floor(p.X()))
+	j := int(math.Floor(p.Y()))
+	k := int(math.Floor(p.Z()))
+	f1, f2 := math.MaxFloat64, math.MaxFloat64
+
+	for di := -1; di <= 1; di++ {
+		for dj := -1; dj <= 1; dj++ {
+			for dk := -1; dk <= 1; dk++ {
+				cell := Point3{float64(i + di), float64(j + dj), float64(k + dk)}
+				feature := cell.Add(pl.randpos[pl.permX[pl.Lattice(i+di)]^
+					pl.permY[pl.Lattice(j+dj)]^
+					pl.permZ[pl.Lattice(k+dk)]])
+
+				dist := feature.Sub(p).Length()
+				if dist < f1 {
+					f1, f2 = dist, f1
+				} else if dist < f2 {
+					f2 = dist
+				}
+			}
+		}
+	}
+
+	return f1, f2
+}
+
+func (pl Perlin) Noise4(p Point3, w float64) float64 {
+	// Gradient noise over a fourth coordinate, typically time, so patterns can evolve smoothly
+	// instead of just sliding through space.
+	x := [4]float64{p.X(), p.Y(), p.Z(), w}
+	cell := [4]int{}
+	frac := [4]float64{}
+	smooth := [4]float64{}
+	for n := range 4 {
+		f := math.Floor(x[n])
+		cell[n] = int(f)
+		frac[n] = x[n] - f
+		smooth[n] = frac[n] * frac[n] * (3 - 2*frac[n])
+	}
+
+	accum := 0.0
+	for corner := range 16 {
+		weight := 1.0
+		dot := 0.0
+		index := 0
+		for n, perm := range [4]*[PointCount]int{&pl.permX, &pl.permY, &pl.permZ, &pl.permW} {
+			d := (corner >> n) & 1
+			if d == 1 {
+				weight *= smooth[n]
+			} else {
+				weight *= 1 - smooth[n]
+			}
+			index ^= perm[pl.Lattice(cell[n]+d)]
+		}
+		g := pl.randvec4[index]
+		for n := range 4 {
+			dot += g[n] * (frac[n] - float64((corner>>n)&1))
+		}
+		accum += weight * dot
+	}
+
+	return accum
+}
+
+func (pl Perlin) Turb4(p Point3, w float64, depth int) float64 {
+	accum := 0.0
+	tempP := p
+	tempW := w
+	weight := 1.0
+
+	for range depth {
+		accum += weight * pl.Noise4(tempP, tempW)
+		weight *= 0.5
+		tempP = tempP.Muln(2)
+		tempW *= 2
+	}
+
+	return math.Abs(accum)
+}
+
+var simplexGradients = [12]Vec3{
+	{1, 1, 0}, {-1, 1, 0}, {1, -1, 0}, {-1, -1, 0},
+	{1, 0, 1}, {-1, 0, 1}, {1, 0, -1}, {-1, 0, -1},
+	{0, 1, 1}, {0, -1, 1}, {0, 1, -1}, {0, -1, -1},
+}
+
+func (pl Perlin) Simplex(p Point3) float64 {
+	// Simplex noise: sums the contributions of the four corners of the skewed tetrahedral cell
+	// around p. Cheaper than Noise and without its axis aligned artifacts. Returns roughly
+	// [-1,1]. The skewed lattice doesn't follow the period set by SetPeriod.
+	const f3 = 1.0 / 3.0
+	const g3 = 1.0 / 6.0
+
+	// Skew the input space to find the simplex cell.
+	s := (p.X() + p.Y() + p.Z()) * f3
+	i := int(math.Floor(p.X() + s))
+	j := int(math.Floor(p.Y() + s))
+	k := int(math.Floor(p.Z() + s))
+	t := float64(i+j+k) * g3
+	p0 := p.Sub(Vec3{float64(i) - t, float64(j) - t, float64(k) - t})
+
+	// Find which of the six tetrahedra p lies in, from the ordering of its coordinates.
+	var o1, o2 [3]int
+	if p0.X() >= p0.Y() {
+		if p0.Y() >= p0.Z() {
+			o1, o2 = [3]int{1, 0, 0}, [3]int{1, 1, 0}
+		} else if p0.X() >= p0.Z() {
+			o1, o2 = [3]int{1, 0, 0}, [3]int{1, 0, 1}
+		} else {
+			o1, o2 = [3]int{0, 0, 1}, [3]int{1, 0, 1}
+		}
+	} else {
+		if p0.Y() < p0.Z() {
+			o1, o2 = [3]int{0, 0, 1}, [3]int{0, 1, 1}
+		} else if p0.X() < p0.Z() {
+			o1, o2 = [3]int{0, 1, 0}, [3]int{0, 1, 1}
+		} else {
+			o1, o2 = [3]int{0, 1, 0}, [3]int{1, 1, 0}
+		}
+	}
+
+	offsets := [4][3]int{{0, 0, 0}, o1, o2, {1, 1, 1}}
+	accum := 0.0
+	for n, o := range offsets {
+		corner := p0.Sub(Vec3{float64(o[0]), float64(o[1]), float64(o[2])}).Add(Vec3{1, 1, 1}.Muln(float64(n) * g3))
+		falloff := 0.6 - corner.Dot(corner)
+		if falloff <= 0 {
+			continue
+		}
+		hash := pl.permX[(i+o[0])&255] ^ pl.permY[(j+o[1])&255] ^ pl.permZ[(k+o[2])&255]
+		falloff *= falloff
+		accum += falloff * falloff * simplexGradients[hash%12].Dot(corner)
+	}
+
+	return 32 * accum
+}
+
+func PerlinGeneratePerm(rng *rand.Rand, p []int) {
 	for i := range PointCount {
 		p[i] = i
 	}
-	Permute(p, PointCount)
+	Permute(rng, p, PointCount)
 }
 
-func Permute(p []int, n int) {
-	for i := range n - 1 {
-		target := int(RandomRange(0, float64(i)))
+func Permute(rng *rand.Rand, p []int, n int) {
+	// Fisher-Yates shuffle: swap each element with one picked from the elements not yet placed.
+	for i := n - 1; i > 0; i-- {
+		target := rng.IntN(i + 1)
 		tmp := p[i]
 		p[i] = p[target]
 		p[target] = tmp
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+type ColorStop struct {
+	pos   float64
+	color RGB
+}
+
+type ColorRamp []ColorStop
+
+func NewColorRamp(stops ...ColorStop) ColorRamp {
+	ramp := ColorRamp(stops)
+	sort.Slice(ramp, func(i, j int) bool {
+		return ramp[i].pos < ramp[j].pos
+	})
+	return ramp
+}
+
+func (ramp ColorRamp) Value(t float64) RGB {
+	// Returns the color at t, interpolated linearly between the surrounding stops and held
+	// constant before the first and after the last one.
+	if len(ramp) == 0 {
+		return RGB{t, t, t}
+	}
+	if t <= ramp[0].pos {
+		return ramp[0].color
+	}
+	for i := 1; i < len(ramp); i++ {
+		if t <= ramp[i].pos {
+			a, b := ramp[i-1], ramp[i]
+			if b.pos <= a.pos {
+				return b.color
+			}
+			return Lerp(a.color, b.color, (t-a.pos)/(b.pos-a.pos))
+		}
+	}
+	return ramp[len(ramp)-1].color
+}
+
+type FBMTexture struct {
+	noise      Perlin
+	scale      float64
+	octaves    int
+	lacunarity float64
+	gain       float64
+	low        Texture
+	high       Texture
+}
+
+func NewFBMTexture(scale float64, octaves int, lacunarity, gain float64, low, high Texture) FBMTexture {
+	return FBMTexture{NewPerlin(), scale, octaves, lacunarity, gain, low, high}
+}
+
+func (t FBMTexture) Value(u, v float64, p Point3) RGB {
+	f := 0.5 + 0.5*t.noise.Fbm(p.Muln(t.scale), t.octaves, t.lacunarity, t.gain)
+	return Lerp(t.low.Value(u, v, p), t.high.Value(u, v, p), Clamp(f, 0, 1))
+}
+
+type RidgedTexture struct {
+	noise      Perlin
+	scale      float64
+	octaves    int
+	lacunarity float64
+	gain       float64
+	offset     float64
+	low        Texture
+	high       Texture
+}
+
+func NewRidgedTexture(scale float64, octaves int, lacunarity, gain, offset float64, low, high Texture) RidgedTexture {
+	return RidgedTexture{NewPerlin(), scale, octaves, lacunarity, gain, offset, low, high}
+}
+
+func (t RidgedTexture) Value(u, v float64, p Point3) RGB {
+	f := t.noise.Ridged(p.Muln(t.scale), t.octaves, t.lacunarity, t.gain, t.offset)
+	return Lerp(t.low.Value(u, v, p), t.high.Value(u, v, p), Clamp(f, 0, 1))
+}
+
+type WorleyTexture struct {
+	noise  Perlin
+	scale  float64
+	border bool // Use the distance to the cell border F2-F1 instead of F1, giving cracks
+	cell   Texture
+	edge   Texture
+}
+
+func NewWorleyTexture(scale float64, border bool, cell, edge Texture) WorleyTexture {
+	return WorleyTexture{NewPerlin(), scale, border, cell, edge}
+}
+
+func (t WorleyTexture) Value(u, v float64, p Point3) RGB {
+	f1, f2 := t.noise.Worley(p.Muln(t.scale))
+	f := f1
+	if t.border {
+		f = 1 - (f2 - f1)
+	}
+	return Lerp(t.cell.Value(u, v, p), t.edge.Value(u, v, p), Clamp(f, 0, 1))
+}
+
+type WoodTexture struct {
+	noise      Perlin
+	scale      float64
+	turbulence float64
+	light      Texture
+	dark       Texture
+}
+
+func NewWoodTexture(scale, turbulence float64, light, dark Texture) WoodTexture {
+	return WoodTexture{NewPerlin(), scale, turbulence, light, dark}
+}
+
+func (t WoodTexture) Value(u, v float64, p Point3) RGB {
+	// Concentric rings around the Y axis, scale rings per unit distance, wobbled by turbulence.
+	q := p.Muln(t.scale)
+	r := math.Sqrt(q.X()*q.X()+q.Z()*q.Z()) + t.turbulence*t.noise.Turb(q, 7)
+	ring := r - math.Floor(r)
+	f := math.Pow(ring, 3)
+	return Lerp(t.light.Value(u, v, p), t.dark.Value(u, v, p), f)
+}
+
+type MarbleTexture struct {
+	noise      Perlin
+	scale      float64
+	turbulence float64
+	ramp       ColorRamp
+}
+
+func NewMarbleTexture(scale, turbulence float64, ramp ColorRamp) MarbleTexture {
+	return MarbleTexture{NewPerlin(), scale, turbulence, ramp}
+}
+
+func (t MarbleTexture) Value(u, v float64, p Point3) RGB {
+	// Same veins as NoiseTexture, with the gray levels mapped through a color ramp.
+	f := 0.5 * (1 + math.Sin(t.scale*p.Z()+t.turbulence*t.noise.Turb(p, 7)))
+	return t.ramp.Value(f)
+}
+
+type WarpTexture struct {
+	tex      Texture
+	noise    Perlin
+	scale    float64
+	strength float64
+}
+
+func NewWarpTexture(tex Texture, scale, strength float64) WarpTexture {
+	return WarpTexture{tex, NewPerlin(), scale, strength}
+}
+
+func (t WarpTexture) Value(u, v float64, p Point3) RGB {
+	// Domain warping: look up the input texture at a point pushed around by a noise vector
+	// field, with the three components sampled at offset positions so they are uncorrelated.
+	q := p.Muln(t.scale)
+	offset := Vec3{
+		t.noise.Fbm(q, 4, 2, 0.5),
+		t.noise.Fbm(q.Add(Vec3{5.2, 1.3, 2.8}), 4, 2, 0.5),
+		t.noise.Fbm(q.Add(Vec3{1.7, 9.2, 4.1}), 4, 2, 0.5),
+	}
+	return t.tex.Value(u, v, p.Add(offset.Muln(t.strength)))
+}
@@ -0,0 +1,182 @@
+package main
+
+import "math"
+
+// A Projection maps points of the film to camera rays. The camera frame (center, u, v, w) and
+// the film size are set up by Camera.Initialize before the projection's own Initialize.
+type Projection interface {
+	Initialize(c *Camera)
+
+	// Returns the ray through the film point (x, y), in pixels from the upper left corner of
+	// the film, or false if the projection doesn't cover that point. Projections with a lens
+	// place the origin on it with the 2D sample (lensU, lensV).
+	Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool)
+
+	// Returns the direction from the center to the right eye of a stereo pair, for a ray
+	// leaving the camera along dir.
+	EyeOffset(c *Camera, dir Vec3) Vec3
+}
+
+type StereoLayout int
+
+const (
+	StereoNone       StereoLayout = iota // A single view
+	StereoSideBySide                     // Left eye on the left half of the image, right eye on the right half
+	StereoOverUnder                      // Left eye on the top half of the image, right eye on the bottom half
+)
+
+type PerspectiveProjection struct{}
+
+func (p PerspectiveProjection) Initialize(c *Camera) {
+	// Thin lens perspective from vfov, focused at focusDist.
+	h := math.Tan(Radians(c.vfov) / 2)
+	viewportHeight := 2 * h * c.focusDist
+	viewportWidth := viewportHeight * (float64(c.filmWidth) / float64(c.filmHeight))
+	c.spreadAngle = math.Atan(2 * h / float64(c.filmHeight))
+
+	// Calculate the vectors across the horizontal and down the vertical viewport edges.
+	viewportU := c.u.Muln(viewportWidth)   // Vector across viewport horizontal edge
+	viewportV := c.v.Muln(-viewportHeight) // Vector down viewport vertical edge
+
+	// Calculate the horizontal and vertical delta vectors from pixel to pixel.
+	c.pixelDeltaU = viewportU.Divn(float64(c.filmWidth))
+	c.pixelDeltaV = viewportV.Divn(float64(c.filmHeight))
+
+	// Calculate the location of the upper left pixel.
+	viewportUpperLeft := c.center.Sub(c.w.Muln(c.focusDist)).Sub(viewportU.Divn(2)).Sub(viewportV.Divn(2))
+	c.pixel00Loc = viewportUpperLeft.Add(c.pixelDeltaU.Add(c.pixelDeltaV).Muln(0.5))
+
+	// Calculate the camera defocus disk basis vectors.
+	defocusRadius := c.focusDist * math.Tan(Radians(c.defocusAngle/2))
+	c.defocusDiskU = c.u.Muln(defocusRadius)
+	c.defocusDiskV = c.v.Muln(defocusRadius)
+}
+
+func (p PerspectiveProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	pixelSample := c.pixel00Loc.Add(c.pixelDeltaU.Muln(x - 0.5)).Add(c.pixelDeltaV.Muln(y - 0.5))
+	orig := c.DefocusDiskSample(lensU, lensV)
+	if c.defocusAngle <= 0 {
+		orig = c.center
+	}
+	return orig, pixelSample.Sub(orig), true
+}
+
+func (p PerspectiveProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return c.u
+}
+
+type OrthographicProjection struct {
+	viewHeight float64 // Height of the view in world units
+}
+
+func (p OrthographicProjection) Initialize(c *Camera) {
+	// Parallel rays have the same footprint at any distance, which the ray cones can't
+	// express, so texture filtering is left off.
+	c.spreadAngle = 0
+}
+
+func (p OrthographicProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	viewWidth := p.viewHeight * float64(c.filmWidth) / float64(c.filmHeight)
+	a := (x/float64(c.filmWidth) - 0.5) * viewWidth
+	b := (0.5 - y/float64(c.filmHeight)) * p.viewHeight
+	orig := c.center.Add(c.u.Muln(a)).Add(c.v.Muln(b))
+	return orig, c.w.Muln(-1), true
+}
+
+func (p OrthographicProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return c.u
+}
+
+type FisheyeMapping int
+
+const (
+	FisheyeEquidistant FisheyeMapping = iota // Distance from the image center proportional to the angle
+	FisheyeEquisolid                         // Area in the image proportional to solid angle
+)
+
+type FisheyeProjection struct {
+	fov     float64 // Angle covered across the image circle, in degrees, can exceed 180
+	mapping FisheyeMapping
+}
+
+func (p FisheyeProjection) Initialize(c *Camera) {
+	c.spreadAngle = Radians(p.fov) / float64(min(c.filmWidth, c.filmHeight))
+}
+
+func (p FisheyeProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	// The image circle fits the shorter side of the film, leaving the corners black.
+	radius := float64(min(c.filmWidth, c.filmHeight)) / 2
+	dx := (x - float64(c.filmWidth)/2) / radius
+	dy := (float64(c.filmHeight)/2 - y) / radius
+	r := math.Hypot(dx, dy)
+	if r > 1 {
+		return Point3{}, Vec3{}, false
+	}
+
+	halfFov := Radians(p.fov) / 2
+	theta := r * halfFov
+	if p.mapping == FisheyeEquisolid {
+		theta = 2 * math.Asin(Clamp(r*math.Sin(halfFov/2), -1, 1))
+	}
+
+	phi := math.Atan2(dy, dx)
+	sinTheta := math.Sin(theta)
+	dir := c.u.Muln(sinTheta * math.Cos(phi)).Add(c.v.Muln(sinTheta * math.Sin(phi))).Sub(c.w.Muln(math.Cos(theta)))
+	return c.center, dir, true
+}
+
+func (p FisheyeProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return c.u
+}
+
+type EquirectangularProjection struct{}
+
+func (p EquirectangularProjection) Initialize(c *Camera) {
+	c.spreadAngle = math.Pi / float64(c.filmHeight)
+}
+
+func (p EquirectangularProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	// Longitude runs around the full width with the view direction in the middle, latitude
+	// from straight up at the top to straight down at the bottom.
+	phi := (x/float64(c.filmWidth) - 0.5) * 2 * math.Pi
+	lambda := (0.5 - y/float64(c.filmHeight)) * math.Pi
+	cosLambda := math.Cos(lambda)
+	dir := c.u.Muln(cosLambda * math.Sin(phi)).Add(c.v.Muln(math.Sin(lambda))).Sub(c.w.Muln(cosLambda * math.Cos(phi)))
+	return c.center, dir, true
+}
+
+func (p EquirectangularProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return OmnidirectionalEyeOffset(c, dir)
+}
+
+type CylindricalProjection struct {
+	hfov float64 // Horizontal angle covered, in degrees, up to 360
+}
+
+func (p CylindricalProjection) Initialize(c *Camera) {
+	c.spreadAngle = Radians(p.hfov) / float64(c.filmWidth)
+}
+
+func (p CylindricalProjection) Ray(c *Camera, x, y, lensU, lensV float64) (Point3, Vec3, bool) {
+	// Angles around the vertical axis spread evenly across the width, heights on the cylinder
+	// evenly down the height, vfov covering the height of the image.
+	phi := (x/float64(c.filmWidth) - 0.5) * Radians(p.hfov)
+	h := math.Tan(Radians(c.vfov) / 2)
+	height := (1 - 2*y/float64(c.filmHeight)) * h
+	dir := c.u.Muln(math.Sin(phi)).Add(c.v.Muln(height)).Sub(c.w.Muln(math.Cos(phi)))
+	return c.center, dir, true
+}
+
+func (p CylindricalProjection) EyeOffset(c *Camera, dir Vec3) Vec3 {
+	return OmnidirectionalEyeOffset(c, dir)
+}
+
+func OmnidirectionalEyeOffset(c *Camera, dir Vec3) Vec3 {
+	// For panoramas the eyes turn with the view direction around the vertical axis, so every
+	// direction is seen with the right parallax, like a head looking around.
+	side := dir.Cross(c.v)
+	if side.NearZero() {
+		return Vec3{}
+	}
+	return side.Normalize()
+}
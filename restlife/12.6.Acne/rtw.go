@@ -1,22 +1,52 @@
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type RTWImage struct {
-	width  int
-	height int
-	raster [][]RGB
+	width      int
+	height     int
+	raster     [][]RGB
+	alpha      [][]float64
+	colorSpace ColorSpace
+	mipmaps    []RTWImage // Successively halved copies of the raster, see GenerateMipmaps
 }
 
+type WrapMode int
+
+const (
+	WrapClamp  WrapMode = iota // Repeat the edge texels
+	WrapRepeat                 // Tile the image
+	WrapMirror                 // Tile the image, flipping every other copy
+)
+
+type ColorSpace int
+
+const (
+	ColorSRGB   ColorSpace = iota // Color images encoded with the sRGB transfer curve
+	ColorLinear                   // Color images that are already linear
+	ColorRaw                      // Non-color data such as normal, roughness or mask maps
+)
+
 func NewRTWImage(filename string) RTWImage {
-	img := RTWImage{}
+	return NewRTWImageColorSpace(filename, ColorSRGB)
+}
+
+func NewRTWImageColorSpace(filename string, colorSpace ColorSpace) RTWImage {
+	img := RTWImage{colorSpace: colorSpace}
 	err := img.Load(filename)
 	if err != nil {
 		log.Fatalf("%#v", err)
@@ -25,31 +55,216 @@ func NewRTWImage(filename string) RTWImage {
 }
 
 func (im *RTWImage) Load(filename string) error {
+	// Loads the image into a linear float raster. 8 and 16 bit images are decoded according to
+	// the image color space, float images (.hdr and .pfm) are always stored as linear values.
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hdr":
+		return im.LoadHDR(bufio.NewReader(file))
+	case ".pfm":
+		return im.LoadPFM(bufio.NewReader(file))
+	}
+
 	img, _, err := image.Decode(file)
 	if err != nil {
 		return err
 	}
 
 	bounds := img.Bounds()
-
-	im.width, im.height = img.Bounds().Dx(), img.Bounds().Dy()
-	im.raster = make([][]RGB, im.width)
-	for i := range im.raster {
-		im.raster[i] = make([]RGB, im.height)
-	}
-	gamma := 2.2
+	im.Allocate(bounds.Dx(), bounds.Dy())
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
+			// Read straight (not premultiplied) alpha at full 16 bit precision.
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
 			i := x - bounds.Min.X
 			j := y - bounds.Min.Y
-			im.raster[i][j] = RGB{math.Pow(float64(r>>8)/255.0, gamma), math.Pow(float64(g>>8)/255.0, gamma), math.Pow(float64(b>>8)/255.0, gamma)}
+			im.raster[i][j] = RGB{im.Decode(c.R), im.Decode(c.G), im.Decode(c.B)}
+			im.alpha[i][j] = float64(c.A) / 0xffff
+		}
+	}
+
+	return nil
+}
+
+func (im RTWImage) Decode(value uint16) float64 {
+	// Converts a stored 16 bit channel value into a linear float.
+	c := float64(value) / 0xffff
+	if im.colorSpace == ColorSRGB {
+		return SRGBToLinear(c)
+	}
+	return c
+}
+
+func SRGBToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func (im *RTWImage) Allocate(width, height int) {
+	// Creates an opaque black raster of the given size.
+	im.width, im.height = width, height
+	im.raster = make([][]RGB, width)
+	im.alpha = make([][]float64, width)
+	for i := range width {
+		im.raster[i] = make([]RGB, height)
+		im.alpha[i] = make([]float64, height)
+		for j := range height {
+			im.alpha[i][j] = 1
+		}
+	}
+	im.mipmaps = nil
+}
+
+func (im *RTWImage) LoadPFM(r *bufio.Reader) error {
+	// Portable float map: a text header with the "PF" (color) or "Pf" (grayscale) magic, the
+	// size and a scale whose sign gives the byte order, followed by rows from bottom to top.
+	var magic string
+	var width, height int
+	var scale float64
+	if _, err := fmt.Fscan(r, &magic, &width, &height, &scale); err != nil {
+		return err
+	}
+	if _, err := r.ReadByte(); err != nil {
+		return err
+	}
+
+	channels := 3
+	switch magic {
+	case "PF":
+	case "Pf":
+		channels = 1
+	default:
+		return fmt.Errorf("pfm: bad magic %q", magic)
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+
+	im.Allocate(width, height)
+	row := make([]float32, width*channels)
+	for y := height - 1; y >= 0; y-- {
+		if err := binary.Read(r, order, row); err != nil {
+			return err
+		}
+		for x := range width {
+			if channels == 1 {
+				g := float64(row[x])
+				im.raster[x][y] = RGB{g, g, g}
+			} else {
+				im.raster[x][y] = RGB{float64(row[3*x]), float64(row[3*x+1]), float64(row[3*x+2])}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (im *RTWImage) LoadHDR(r *bufio.Reader) error {
+	// Radiance RGBE: text header lines up to a blank line, the resolution line, then scanlines
+	// that are either flat or run length encoded one channel at a time.
+	magic, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(magic, "#?") {
+		return fmt.Errorf("hdr: bad magic %q", magic)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return fmt.Errorf("hdr: unsupported %s", line)
+		}
+	}
+
+	var width, height int
+	if _, err := fmt.Fscanf(r, "-Y %d +X %d\n", &height, &width); err != nil {
+		return fmt.Errorf("hdr: unsupported resolution line: %w", err)
+	}
+
+	im.Allocate(width, height)
+	scanline := make([]byte, 4*width)
+	for y := range height {
+		if err := ReadHDRScanline(r, scanline, width); err != nil {
+			return err
+		}
+		for x := range width {
+			rgbe := scanline[4*x : 4*x+4]
+			if rgbe[3] == 0 {
+				continue
+			}
+			f := math.Ldexp(1, int(rgbe[3])-(128+8))
+			im.raster[x][y] = RGB{float64(rgbe[0]) * f, float64(rgbe[1]) * f, float64(rgbe[2]) * f}
+		}
+	}
+
+	return nil
+}
+
+func ReadHDRScanline(r *bufio.Reader, scanline []byte, width int) error {
+	header := scanline[:4]
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	// Flat scanlines store the RGBE bytes of each pixel in turn.
+	if width < 8 || width > 0x7fff || header[0] != 2 || header[1] != 2 || header[2]&0x80 != 0 {
+		_, err := io.ReadFull(r, scanline[4:])
+		return err
+	}
+	if int(header[2])<<8|int(header[3]) != width {
+		return fmt.Errorf("hdr: scanline width mismatch")
+	}
+
+	// Encoded scanlines store each channel as runs of a repeated byte or literal bytes.
+	for channel := range 4 {
+		for x := 0; x < width; {
+			count, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				n := int(count) - 128
+				value, err := r.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > width {
+					return fmt.Errorf("hdr: bad scanline data")
+				}
+				for range n {
+					scanline[4*x+channel] = value
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x+n > width {
+					return fmt.Errorf("hdr: bad scanline data")
+				}
+				for range n {
+					value, err := r.ReadByte()
+					if err != nil {
+						return err
+					}
+					scanline[4*x+channel] = value
+					x++
+				}
+			}
 		}
 	}
 
@@ -63,6 +278,13 @@ func (im RTWImage) Get(x, y int) RGB {
 	return im.raster[x][y]
 }
 
+func (im RTWImage) GetAlpha(x, y int, wrap WrapMode) float64 {
+	x = WrapIndex(x, im.width, wrap)
+	y = WrapIndex(y, im.height, wrap)
+
+	return im.alpha[x][y]
+}
+
 func (im *RTWImage) Set(x, y int, rgb RGB) bool {
 	if x < 0 || x > im.width {
 		return false
@@ -74,3 +296,112 @@ func (im *RTWImage) Set(x, y int, rgb RGB) bool {
 	im.raster[x][y] = rgb
 	return true
 }
+
+func (im RTWImage) GetWrapped(x, y int, wrap WrapMode) RGB {
+	x = WrapIndex(x, im.width, wrap)
+	y = WrapIndex(y, im.height, wrap)
+
+	return im.raster[x][y]
+}
+
+func WrapIndex(i, n int, wrap WrapMode) int {
+	switch wrap {
+	case WrapRepeat:
+		i %= n
+		if i < 0 {
+			i += n
+		}
+	case WrapMirror:
+		period := 2 * n
+		i %= period
+		if i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - 1 - i
+		}
+	default:
+		i = Clamp(i, 0, n-1)
+	}
+	return i
+}
+
+func (im RTWImage) Bilerp(s, t float64, wrap WrapMode) RGB {
+	// Bilinearly interpolates the four texels around the image coordinates s, t in [0,1],
+	// with t = 0 at the top row. Texel centers sit at half-integer positions.
+	x := s*float64(im.width) - 0.5
+	y := t*float64(im.height) - 0.5
+	x0 := int(math.Floor(x))
+	y0 := int(math.Floor(y))
+	dx := x - float64(x0)
+	dy := y - float64(y0)
+
+	top := im.GetWrapped(x0, y0, wrap).Muln(1 - dx).Add(im.GetWrapped(x0+1, y0, wrap).Muln(dx))
+	bottom := im.GetWrapped(x0, y0+1, wrap).Muln(1 - dx).Add(im.GetWrapped(x0+1, y0+1, wrap).Muln(dx))
+
+	return top.Muln(1 - dy).Add(bottom.Muln(dy))
+}
+
+func (im RTWImage) BilerpAlpha(s, t float64, wrap WrapMode) float64 {
+	// Same as Bilerp, for the alpha channel.
+	x := s*float64(im.width) - 0.5
+	y := t*float64(im.height) - 0.5
+	x0 := int(math.Floor(x))
+	y0 := int(math.Floor(y))
+	dx := x - float64(x0)
+	dy := y - float64(y0)
+
+	top := im.GetAlpha(x0, y0, wrap)*(1-dx) + im.GetAlpha(x0+1, y0, wrap)*dx
+	bottom := im.GetAlpha(x0, y0+1, wrap)*(1-dx) + im.GetAlpha(x0+1, y0+1, wrap)*dx
+
+	return top*(1-dy) + bottom*dy
+}
+
+func (im *RTWImage) GenerateMipmaps() {
+	// Builds the mip pyramid by repeatedly averaging 2x2 texel blocks, down to a single texel.
+	im.mipmaps = nil
+	level := *im
+	for level.width > 1 || level.height > 1 {
+		next := RTWImage{colorSpace: im.colorSpace}
+		next.Allocate(max(level.width/2, 1), max(level.height/2, 1))
+		for i := range next.width {
+			for j := range next.height {
+				sum := level.Get(2*i, 2*j).Add(level.Get(2*i+1, 2*j)).Add(level.Get(2*i, 2*j+1)).Add(level.Get(2*i+1, 2*j+1))
+				next.raster[i][j] = sum.Muln(0.25)
+				alpha := level.GetAlpha(2*i, 2*j, WrapClamp) + level.GetAlpha(2*i+1, 2*j, WrapClamp) +
+					level.GetAlpha(2*i, 2*j+1, WrapClamp) + level.GetAlpha(2*i+1, 2*j+1, WrapClamp)
+				next.alpha[i][j] = alpha * 0.25
+			}
+		}
+		im.mipmaps = append(im.mipmaps, next)
+		level = next
+	}
+}
+
+func (im RTWImage) Levels() int {
+	return len(im.mipmaps) + 1
+}
+
+func (im RTWImage) Level(level int) RTWImage {
+	// Returns the mip level, with level 0 being the full resolution image.
+	level = Clamp(level, 0, len(im.mipmaps))
+	if level == 0 {
+		return im
+	}
+	return im.mipmaps[level-1]
+}
+
+func (im RTWImage) Trilerp(s, t, lod float64, wrap WrapMode) RGB {
+	// Blends bilinear lookups from the two mip levels around the fractional level of detail.
+	lod = Clamp(lod, 0, float64(im.Levels()-1))
+	level := int(math.Floor(lod))
+	if level >= im.Levels()-1 {
+		return im.Level(level).Bilerp(s, t, wrap)
+	}
+
+	delta := lod - float64(level)
+	fine := im.Level(level).Bilerp(s, t, wrap)
+	coarse := im.Level(level+1).Bilerp(s, t, wrap)
+
+	return fine.Muln(1 - delta).Add(coarse.Muln(delta))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"sync"
+)
+
+// A Sampler provides the sample values of a pixel sample, one dimension after the other: the
+// position on the film, then the lens and time, then the scattering and light choices of every
+// bounce. Samplers that spread the samples of a pixel evenly in each dimension converge faster
+// than independent random numbers.
+type Sampler interface {
+	// Starts the sample index of the pixel (i, j), out of samplesPerPixel, from the first
+	// dimension.
+	StartPixelSample(i, j, index, samplesPerPixel int)
+
+	// Returns the value of the next dimension, in [0, 1).
+	Get1D() float64
+
+	// Returns the values of the next two dimensions, in [0, 1).
+	Get2D() (float64, float64)
+}
+
+type IndependentSampler struct{}
+
+func (s IndependentSampler) StartPixelSample(i, j, index, samplesPerPixel int) {}
+
+func (s IndependentSampler) Get1D() float64 {
+	return rand.Float64()
+}
+
+func (s IndependentSampler) Get2D() (float64, float64) {
+	return rand.Float64(), rand.Float64()
+}
+
+type StratifiedSampler struct {
+	// Jittered sampling: every dimension is split into as many strata as there are samples,
+	// the pairs of 2D dimensions into a grid of about square cells, and every sample falls
+	// in its own stratum. The strata are shuffled differently for every pixel and dimension,
+	// so the dimensions aren't correlated. The jitter within the stratum is hashed from the
+	// pixel, sample index and dimension too, so a sample has the same values on every run.
+	seed      uint64
+	index     int
+	spp       int
+	xStrata   int
+	yStrata   int
+	dimension int
+}
+
+func (s *StratifiedSampler) StartPixelSample(i, j, index, samplesPerPixel int) {
+	if samplesPerPixel != s.spp {
+		// The grid uses the factors of the sample count closest to its square root, so it has
+		// exactly one cell per sample even when the count isn't a square.
+		s.spp = samplesPerPixel
+		s.xStrata = int(math.Sqrt(float64(samplesPerPixel)))
+		for samplesPerPixel%s.xStrata != 0 {
+			s.xStrata--
+		}
+		s.yStrata = samplesPerPixel / s.xStrata
+	}
+	s.seed = MixBits(uint64(i), uint64(j))
+	s.index = index
+	s.dimension = 0
+}
+
+func (s *StratifiedSampler) Get1D() float64 {
+	stratum, jitter := s.Stratum()
+	return min((float64(stratum)+float64(uint32(jitter))*0x1p-32)/float64(s.spp), OneMinusEpsilon)
+}
+
+func (s *StratifiedSampler) Get2D() (float64, float64) {
+	stratum, jitter := s.Stratum()
+	x, y := stratum%s.xStrata, stratum/s.xStrata
+	jx, jy := float64(uint32(jitter))*0x1p-32, float64(uint32(jitter>>32))*0x1p-32
+	return min((float64(x)+jx)/float64(s.xStrata), OneMinusEpsilon), min((float64(y)+jy)/float64(s.yStrata), OneMinusEpsilon)
+}
+
+func (s *StratifiedSampler) Stratum() (int, uint64) {
+	// Returns the stratum of the sample in the next dimension, and random bits for the jitter
+	// within it. Samples past the count, like the extra samples of adaptive sampling, start
+	// over with the strata, with a different jitter.
+	seed := MixBits(s.seed, uint64(s.dimension))
+	s.dimension++
+	return int(PermutationElement(uint32(s.index%s.spp), uint32(s.spp), uint32(seed))), MixBits(seed, uint64(s.index))
+}
+
+// The primes used as the bases of the dimensions of the Halton sequence. Dimensions past them
+// reuse the bases, with a different scrambling.
+var HaltonPrimes = []uint64{
+	2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53,
+	59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131,
+}
+
+type HaltonSampler struct {
+	// The Halton sequence, the radical inverse of the sample index in a different prime base
+	// for every dimension, each Owen scrambled by seeds from the pixel.
+	seed      uint64
+	index     uint64
+	dimension int
+}
+
+func (s *HaltonSampler) StartPixelSample(i, j, index, samplesPerPixel int) {
+	s.seed = MixBits(uint64(i), uint64(j))
+	s.index = uint64(index)
+	s.dimension = 0
+}
+
+func (s *HaltonSampler) Get1D() float64 {
+	base := HaltonPrimes[s.dimension%len(HaltonPrimes)]
+	value := OwenScrambledRadicalInverse(s.index, base, MixBits(s.seed, uint64(s.dimension)))
+	s.dimension++
+	return value
+}
+
+func (s *HaltonSampler) Get2D() (float64, float64) {
+	return s.Get1D(), s.Get1D()
+}
+
+func OwenScrambledRadicalInverse(a, base, seed uint64) float64 {
+	// Mirrors the digits of a in base around the radix point, permuting every digit by a
+	// permutation picked by the digits before it. The digits are produced until they no
+	// longer change the result, so the scrambled zeros past the end of a count too.
+	invBase := 1 / float64(base)
+	invBaseM := 1.0
+	reversed := 0.0
+	prefix := seed
+	for 1-float64(base-1)*invBaseM < 1 {
+		next := a / base
+		digit := a - next*base
+		digit = uint64(PermutationElement(uint32(digit), uint32(base), uint32(MixBits(prefix))))
+		prefix = MixBits(prefix, digit)
+		reversed = reversed*float64(base) + float64(digit)
+		invBaseM *= invBase
+		a = next
+	}
+	return min(reversed*invBaseM, OneMinusEpsilon)
+}
+
+type SobolSampler struct {
+	// Owen scrambled Sobol points, padded to any number of dimensions by shuffling the points
+	// of the first two Sobol dimensions differently for every pair of dimensions, following
+	// Burley's "Practical Hash-based Owen Scrambling".
+	seed      uint64
+	index     uint32
+	dimension int
+}
+
+func (s *SobolSampler) StartPixelSample(i, j, index, samplesPerPixel int) {
+	s.seed = MixBits(uint64(i), uint64(j))
+	s.index = uint32(index)
+	s.dimension = 0
+}
+
+func (s *SobolSampler) Get1D() float64 {
+	x, _ := ShuffledScrambledSobol(s.index, MixBits(s.seed, uint64(s.dimension)))
+	s.dimension++
+	return x
+}
+
+func (s *SobolSampler) Get2D() (float64, float64) {
+	x, y := ShuffledScrambledSobol(s.index, MixBits(s.seed, uint64(s.dimension)))
+	s.dimension += 2
+	return x, y
+}
+
+// The direction numbers of the first two dimensions of the Sobol sequence. The first one is
+// the van der Corput sequence, the second follows the polynomial x + 1.
+var SobolDirections = func() [2][32]uint32 {
+	var directions [2][32]uint32
+	v := uint32(1) << 31
+	for bit := range 32 {
+		directions[0][bit] = 1 << (31 - bit)
+		directions[1][bit] = v
+		v ^= v >> 1
+	}
+	return directions
+}()
+
+func ShuffledScrambledSobol(index uint32, seed uint64) (float64, float64) {
+	// Shuffling the order of the points keeps their stratification, as long as the shuffle
+	// is a nested uniform scramble of the index.
+	index = NestedUniformScramble(index, uint32(seed))
+	var x, y uint32
+	for bit := 0; index != 0; bit++ {
+		if index&1 != 0 {
+			x ^= SobolDirections[0][bit]
+			y ^= SobolDirections[1][bit]
+		}
+		index >>= 1
+	}
+	x = NestedUniformScramble(x, uint32(MixBits(seed, 0)))
+	y = NestedUniformScramble(y, uint32(MixBits(seed, 1)))
+	return min(float64(x)*0x1p-32, OneMinusEpsilon), min(float64(y)*0x1p-32, OneMinusEpsilon)
+}
+
+func NestedUniformScramble(x, seed uint32) uint32 {
+	// Owen scrambling of the bits of x, from the most significant, with the hash of Laine and
+	// Karras that only lets bits depend on the bits below them.
+	x = bits.Reverse32(x)
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return bits.Reverse32(x)
+}
+
+type BlueNoiseSampler struct {
+	// The same Owen scrambled Sobol points in every pixel, shifted by a blue noise mask so
+	// the error of neighboring pixels differs as much as possible. At low sample counts the
+	// noise is then spread at high frequencies, where it is less visible and filters out
+	// well. Every dimension reads the mask at a different offset.
+	sobol SobolSampler
+	i, j  int
+}
+
+func (s *BlueNoiseSampler) StartPixelSample(i, j, index, samplesPerPixel int) {
+	s.sobol.StartPixelSample(0, 0, index, samplesPerPixel)
+	s.i, s.j = i, j
+}
+
+func (s *BlueNoiseSampler) Get1D() float64 {
+	shift := s.Shift(s.sobol.dimension)
+	x := s.sobol.Get1D() + shift
+	return min(x-math.Floor(x), OneMinusEpsilon)
+}
+
+func (s *BlueNoiseSampler) Get2D() (float64, float64) {
+	shiftX, shiftY := s.Shift(s.sobol.dimension), s.Shift(s.sobol.dimension+1)
+	x, y := s.sobol.Get2D()
+	x, y = x+shiftX, y+shiftY
+	return min(x-math.Floor(x), OneMinusEpsilon), min(y-math.Floor(y), OneMinusEpsilon)
+}
+
+func (s *BlueNoiseSampler) Shift(dimension int) float64 {
+	mask := BlueNoise()
+	offset := MixBits(uint64(dimension))
+	i := (s.i + int(offset%BlueNoiseSize)) % BlueNoiseSize
+	j := (s.j + int(offset/BlueNoiseSize%BlueNoiseSize)) % BlueNoiseSize
+	return mask[j*BlueNoiseSize+i]
+}
+
+// Size of the tileable blue noise mask.
+const BlueNoiseSize = 64
+
+var BlueNoise = sync.OnceValue(func() []float64 {
+	// Builds the blue noise mask with Ulichney's void and cluster method: points are ranked
+	// by adding them one at a time where the pattern has its largest void, measured by the
+	// Gaussian weighted sum of the points around, wrapping around the edges.
+	const n = BlueNoiseSize * BlueNoiseSize
+	const sigma = 1.5
+	var kernel [BlueNoiseSize * BlueNoiseSize]float64
+	for j := range BlueNoiseSize {
+		for i := range BlueNoiseSize {
+			dx := float64(min(i, BlueNoiseSize-i))
+			dy := float64(min(j, BlueNoiseSize-j))
+			kernel[j*BlueNoiseSize+i] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+		}
+	}
+
+	ones := make([]bool, n)
+	energy := make([]float64, n)
+	toggle := func(k int) {
+		sign := 1.0
+		if ones[k] {
+			sign = -1
+		}
+		ones[k] = !ones[k]
+		ki, kj := k%BlueNoiseSize, k/BlueNoiseSize
+		for j := range BlueNoiseSize {
+			row := (j - kj + BlueNoiseSize) % BlueNoiseSize * BlueNoiseSize
+			for i := range BlueNoiseSize {
+				energy[j*BlueNoiseSize+i] += sign * kernel[row+(i-ki+BlueNoiseSize)%BlueNoiseSize]
+			}
+		}
+	}
+	extreme := func(value bool, largest bool) int {
+		// Returns the point or hole with the largest or smallest energy.
+		best := -1
+		for k := range n {
+			if ones[k] != value {
+				continue
+			}
+			if best < 0 || largest && energy[k] > energy[best] || !largest && energy[k] < energy[best] {
+				best = k
+			}
+		}
+		return best
+	}
+
+	// Start from a random tenth of the points, evened out by moving the point in the tightest
+	// cluster to the largest void until it lands back where it was.
+	rng := rand.New(rand.NewPCG(1, 2))
+	initial := n / 10
+	for _, k := range rng.Perm(n)[:initial] {
+		toggle(k)
+	}
+	for {
+		cluster := extreme(true, true)
+		toggle(cluster)
+		void := extreme(false, false)
+		toggle(void)
+		if void == cluster {
+			break
+		}
+	}
+	prototype := append([]bool(nil), ones...)
+	prototypeEnergy := append([]float64(nil), energy...)
+
+	// Rank the initial points by removing the tightest clusters first, then the rest of the
+	// holes by filling the largest voids.
+	ranks := make([]int, n)
+	for rank := initial - 1; rank >= 0; rank-- {
+		cluster := extreme(true, true)
+		toggle(cluster)
+		ranks[cluster] = rank
+	}
+	copy(ones, prototype)
+	copy(energy, prototypeEnergy)
+	for rank := initial; rank < n; rank++ {
+		void := extreme(false, false)
+		toggle(void)
+		ranks[void] = rank
+	}
+
+	mask := make([]float64, n)
+	for k, rank := range ranks {
+		mask[k] = (float64(rank) + 0.5) / n
+	}
+	return mask
+})
+
+// The largest float64 below one.
+const OneMinusEpsilon = 0x1.fffffffffffffp-1
+
+func MixBits(values ...uint64) uint64 {
+	// Hashes the values into well mixed bits, with the finalizer of MurmurHash3.
+	h := uint64(0x9e3779b97f4a7c15)
+	for _, v := range values {
+		h ^= v + 0x9e3779b97f4a7c15 + h<<6 + h>>2
+		h ^= h >> 33
+		h *= 0xff51afd7ed558ccd
+		h ^= h >> 33
+		h *= 0xc4ceb9fe1a85ec53
+		h ^= h >> 33
+	}
+	return h
+}
+
+func PermutationElement(i, n, seed uint32) uint32 {
+	// Returns the element at i of a random permutation of [0, n) picked by seed, without
+	// building it, with Kensler's hash that is a bijection over the bits spanning n, walking
+	// the cycle until a value falls below n.
+	w := n - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= seed
+		i *= 0xe170893d
+		i ^= seed >> 16
+		i ^= (i & w) >> 4
+		i ^= seed >> 8
+		i *= 0x0929eb3f
+		i ^= seed >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | seed>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < n {
+			break
+		}
+	}
+	return (i + seed) % n
+}
@@ -0,0 +1,261 @@
+package main
+
+import "math"
+
+// A signed distance function: negative inside the shape, positive outside, and never more
+// than the distance to the closest surface point.
+type SDF func(p Point3) float64
+
+type SDFHittable struct {
+	sdf       SDF
+	bbox      AABB
+	mat       Material
+	stepScale float64 // Fraction of the distance bound marched per step
+	maxSteps  int
+	epsilon   float64
+}
+
+func NewSDFHittable(sdf SDF, bbox AABB, mat Material) SDFHittable {
+	// The surface must lie inside the bounding box, marching starts and stops at its sides.
+	return SDFHittable{sdf, bbox, mat, 1, 512, 1e-4}
+}
+
+func (hit *SDFHittable) SetStepScale(stepScale float64) {
+	// Functions that overestimate the distance, like twisted or smoothly blended shapes, need
+	// shorter steps so the march doesn't skip over thin features.
+	hit.stepScale = stepScale
+}
+
+func (hit SDFHittable) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	ok, clipped := hit.bbox.Clip(r, intvl)
+	if !ok {
+		return false, HitRecord{}
+	}
+
+	// March in units of distance, on the side of the surface where the ray starts, so rays
+	// refracted into the shape find their way out too.
+	rayLength := r.dir.Length()
+	t := clipped.min
+	side := 1.0
+	if hit.sdf(r.At(t)) < 0 {
+		side = -1
+	}
+
+	// Scattered rays start on the surface, which must be left before it can be hit again.
+	leftSurface, converged := false, false
+	prevT := t
+	for range hit.maxSteps {
+		if t > clipped.max {
+			return false, HitRecord{}
+		}
+
+		d := side * hit.sdf(r.At(t))
+		if d < 0 {
+			// Stepped through the surface, refine the crossing by bisection.
+			t = hit.Bisect(r, side, prevT, t)
+			converged = true
+			break
+		}
+		if d < hit.epsilon {
+			if leftSurface {
+				converged = true
+				break
+			}
+		} else {
+			leftSurface = true
+		}
+
+		prevT = t
+		t += math.Max(hit.stepScale*d, hit.epsilon) / rayLength
+	}
+
+	// Running out of steps short of the surface is a miss, not a hit where the march stopped.
+	if !converged || !intvl.Surrounds(t) || t > clipped.max {
+		return false, HitRecord{}
+	}
+
+	rec := HitRecord{}
+	rec.t = t
+	rec.p = r.At(t)
+	outwardNormal := hit.Normal(rec.p)
+	rec.SetFaceNormal(r, outwardNormal)
+	rec.objectP, rec.objectNormal = rec.p, outwardNormal
+	uvw := NewONB(outwardNormal)
+	rec.dpdu, rec.dpdv = uvw.U(), uvw.V()
+	rec.mat = hit.mat
+
+	return true, rec
+}
+
+func (hit SDFHittable) Bisect(r Ray, side, t0, t1 float64) float64 {
+	// Returns the ray parameter where the distance changes sign between t0 and t1.
+	for range 32 {
+		mid := (t0 + t1) / 2
+		if side*hit.sdf(r.At(mid)) < 0 {
+			t1 = mid
+		} else {
+			t0 = mid
+		}
+	}
+	return t1
+}
+
+func (hit SDFHittable) Normal(p Point3) Vec3 {
+	// The gradient of the distance, by central differences, points away from the surface.
+	h := hit.epsilon
+	n := Vec3{
+		hit.sdf(p.Add(Vec3{h, 0, 0})) - hit.sdf(p.Sub(Vec3{h, 0, 0})),
+		hit.sdf(p.Add(Vec3{0, h, 0})) - hit.sdf(p.Sub(Vec3{0, h, 0})),
+		hit.sdf(p.Add(Vec3{0, 0, h})) - hit.sdf(p.Sub(Vec3{0, 0, h})),
+	}
+	if n.NearZero() {
+		return Vec3{0, 1, 0}
+	}
+	return n.Normalize()
+}
+
+func (hit SDFHittable) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit SDFHittable) PDFValue(origin Point3, direction Vec3) float64 {
+	return 0
+}
+
+func (hit SDFHittable) Random(origin Point3, s Sampler) Vec3 {
+	return Vec3{1, 0, 0}
+}
+
+func SDFSphere(center Point3, radius float64) SDF {
+	return func(p Point3) float64 {
+		return p.Sub(center).Length() - radius
+	}
+}
+
+func SDFBox(center Point3, halfSize Vec3) SDF {
+	return func(p Point3) float64 {
+		q := p.Sub(center)
+		q = Vec3{math.Abs(q.X()) - halfSize.X(), math.Abs(q.Y()) - halfSize.Y(), math.Abs(q.Z()) - halfSize.Z()}
+		outside := Vec3{math.Max(q.X(), 0), math.Max(q.Y(), 0), math.Max(q.Z(), 0)}.Length()
+		inside := math.Min(math.Max(q.X(), math.Max(q.Y(), q.Z())), 0)
+		return outside + inside
+	}
+}
+
+func SDFRoundBox(center Point3, halfSize Vec3, radius float64) SDF {
+	// A box with its edges and corners rounded off by radius, keeping the overall size.
+	inner := halfSize.Sub(Vec3{radius, radius, radius})
+	return SDFRound(SDFBox(center, inner), radius)
+}
+
+func SDFTorus(center Point3, majorRadius, minorRadius float64) SDF {
+	// A torus around the Y axis.
+	return func(p Point3) float64 {
+		q := p.Sub(center)
+		ring := math.Hypot(q.X(), q.Z()) - majorRadius
+		return math.Hypot(ring, q.Y()) - minorRadius
+	}
+}
+
+func SDFRound(a SDF, radius float64) SDF {
+	// Inflates the shape by radius, rounding its edges.
+	return func(p Point3) float64 {
+		return a(p) - radius
+	}
+}
+
+func SDFUnion(a, b SDF) SDF {
+	return func(p Point3) float64 {
+		return math.Min(a(p), b(p))
+	}
+}
+
+func SDFIntersection(a, b SDF) SDF {
+	return func(p Point3) float64 {
+		return math.Max(a(p), b(p))
+	}
+}
+
+func SDFDifference(a, b SDF) SDF {
+	return func(p Point3) float64 {
+		return math.Max(a(p), -b(p))
+	}
+}
+
+func SDFSmoothUnion(a, b SDF, k float64) SDF {
+	// Blends the two shapes together over a distance of about k.
+	return func(p Point3) float64 {
+		da, db := a(p), b(p)
+		h := Clamp(0.5+0.5*(db-da)/k, 0, 1)
+		return db*(1-h) + da*h - k*h*(1-h)
+	}
+}
+
+func SDFSmoothDifference(a, b SDF, k float64) SDF {
+	// Carves b out of a with a fillet of about k.
+	return func(p Point3) float64 {
+		da, db := a(p), b(p)
+		h := Clamp(0.5-0.5*(da+db)/k, 0, 1)
+		return da*(1-h) - db*h + k*h*(1-h)
+	}
+}
+
+func SDFTranslate(a SDF, offset Vec3) SDF {
+	return func(p Point3) float64 {
+		return a(p.Sub(offset))
+	}
+}
+
+func SDFRepeat(a SDF, period Vec3) SDF {
+	// Repeats the shape around the origin infinitely along the axes with a non-zero period.
+	// The shape should fit in one period cell, centered on the origin.
+	return func(p Point3) float64 {
+		q := p
+		for axis := range 3 {
+			if period[axis] > 0 {
+				q[axis] = p[axis] - period[axis]*math.Round(p[axis]/period[axis])
+			}
+		}
+		return a(q)
+	}
+}
+
+func SDFTwist(a SDF, k float64) SDF {
+	// Twists the shape around the Y axis by k radians per unit of height. The result is no
+	// longer an exact distance, so use a step scale below one.
+	return func(p Point3) float64 {
+		c := math.Cos(k * p.Y())
+		s := math.Sin(k * p.Y())
+		return a(Point3{c*p.X() - s*p.Z(), p.Y(), s*p.X() + c*p.Z()})
+	}
+}
+
+func SDFMandelbulb(center Point3, scale, power float64, iterations int) SDF {
+	// Distance estimate to the Mandelbulb fractal, which fits in a sphere of radius about
+	// 1.2 scale around the center.
+	return func(p Point3) float64 {
+		c := p.Sub(center).Divn(scale)
+		z := c
+		dr := 1.0
+		r := 0.0
+
+		for range iterations {
+			r = z.Length()
+			if r > 2 || r < 1e-12 {
+				break
+			}
+
+			// Raise z to the power in spherical coordinates, and add the starting point.
+			theta := math.Acos(z.Z()/r) * power
+			phi := math.Atan2(z.Y(), z.X()) * power
+			dr = math.Pow(r, power-1)*power*dr + 1
+			zr := math.Pow(r, power)
+			z = Vec3{math.Sin(theta) * math.Cos(phi), math.Sin(phi) * math.Sin(theta), math.Cos(theta)}.Muln(zr).Add(c)
+		}
+
+		if r < 1e-12 {
+			return 0
+		}
+		return 0.5 * math.Log(r) * r / dr * scale
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+func DiskExtent(axis Vec3, radius float64) Vec3 {
+	// Returns the half size along each world axis of a disk with the given unit normal.
+	return Vec3{
+		radius * math.Sqrt(math.Max(0, 1-axis.X()*axis.X())),
+		radius * math.Sqrt(math.Max(0, 1-axis.Y()*axis.Y())),
+		radius * math.Sqrt(math.Max(0, 1-axis.Z()*axis.Z())),
+	}
+}
+
+type Cylinder struct {
+	base   Point3
+	frame  ONB // Local frame with the axis as W
+	radius float64
+	height float64
+	mat    Material
+	bbox   AABB
+	area   float64
+}
+
+func NewCylinder(base Point3, axis Vec3, radius, height float64, mat Material) Cylinder {
+	// An open tube from the center of its base along the axis; close it with disks if needed.
+	frame := NewONB(axis)
+	top := base.Add(frame.W().Muln(height))
+	extent := DiskExtent(frame.W(), radius)
+	bbox := NewAABBBox(NewAABBPoint(base.Sub(extent), base.Add(extent)), NewAABBPoint(top.Sub(extent), top.Add(extent)))
+	area := 2 * math.Pi * radius * height
+	return Cylinder{base, frame, radius, height, mat, bbox, area}
+}
+
+func (hit Cylinder) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	// Intersect in the local frame, where the tube is x^2 + y^2 = radius^2 for 0 <= z <= height.
+	o := hit.frame.ToLocal(r.orig.Sub(hit.base))
+	d := hit.frame.ToLocal(r.dir)
+
+	a := d.X()*d.X() + d.Y()*d.Y()
+	h := -(o.X()*d.X() + o.Y()*d.Y())
+	c := o.X()*o.X() + o.Y()*o.Y() - hit.radius*hit.radius
+
+	for _, root := range SolveQuadratic(a, h, c) {
+		if !intvl.Surrounds(root) {
+			continue
+		}
+		local := o.Add(d.Muln(root))
+		if local.Z() < 0 || local.Z() > hit.height {
+			continue
+		}
+
+		phi := math.Atan2(local.Y(), local.X())
+		if phi < 0 {
+			phi += 2 * math.Pi
+		}
+
+		rec := HitRecord{}
+		rec.t = root
+		rec.p = r.At(root)
+		outwardNormal := hit.frame.Transform(Vec3{local.X(), local.Y(), 0}.Divn(hit.radius))
+		rec.SetFaceNormal(r, outwardNormal)
+		rec.objectP, rec.objectNormal = rec.p, outwardNormal
+		rec.u = phi / (2 * math.Pi)
+		rec.v = local.Z() / hit.height
+		rec.dpdu = hit.frame.Transform(Vec3{-local.Y(), local.X(), 0}.Muln(2 * math.Pi))
+		rec.dpdv = hit.frame.W().Muln(hit.height)
+		rec.mat = hit.mat
+		return true, rec
+	}
+
+	return false, HitRecord{}
+}
+
+func (hit Cylinder) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Cylinder) PDFValue(origin Point3, direction Vec3) float64 {
+	return AreaPDFValue(hit, hit.area, origin, direction)
+}
+
+func (hit Cylinder) Random(origin Point3, s Sampler) Vec3 {
+	r1, r2 := s.Get2D()
+	phi := 2 * math.Pi * r1
+	local := Vec3{hit.radius * math.Cos(phi), hit.radius * math.Sin(phi), hit.height * r2}
+	return hit.base.Add(hit.frame.Transform(local)).Sub(origin)
+}
+
+type Cone struct {
+	base   Point3
+	frame  ONB // Local frame with the axis as W
+	radius float64
+	height float64
+	mat    Material
+	bbox   AABB
+	area   float64
+}
+
+func NewCone(base Point3, axis Vec3, radius, height float64, mat Material) Cone {
+	// An open cone with the given radius at the center of its base, and its apex height
+	// further along the axis.
+	frame := NewONB(axis)
+	apex := base.Add(frame.W().Muln(height))
+	extent := DiskExtent(frame.W(), radius)
+	bbox := NewAABBBox(NewAABBPoint(base.Sub(extent), base.Add(extent)), NewAABBPoint(apex, apex))
+	area := math.Pi * radius * math.Sqrt(radius*radius+height*height)
+	return Cone{base, frame, radius, height, mat, bbox, area}
+}
+
+func (hit Cone) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	// Intersect in the local frame, where the cone is x^2 + y^2 = k^2 (height - z)^2 with
+	// k = radius / height, for 0 <= z <= height.
+	o := hit.frame.ToLocal(r.orig.Sub(hit.base))
+	d := hit.frame.ToLocal(r.dir)
+	k2 := hit.radius * hit.radius / (hit.height * hit.height)
+	hz := hit.height - o.Z()
+
+	a := d.X()*d.X() + d.Y()*d.Y() - k2*d.Z()*d.Z()
+	h := -(o.X()*d.X() + o.Y()*d.Y() + k2*hz*d.Z())
+	c := o.X()*o.X() + o.Y()*o.Y() - k2*hz*hz
+
+	for _, root := range SolveQuadratic(a, h, c) {
+		if !intvl.Surrounds(root) {
+			continue
+		}
+		local := o.Add(d.Muln(root))
+		if local.Z() < 0 || local.Z() > hit.height {
+			continue
+		}
+
+		phi := math.Atan2(local.Y(), local.X())
+		if phi < 0 {
+			phi += 2 * math.Pi
+		}
+
+		rec := HitRecord{}
+		rec.t = root
+		rec.p = r.At(root)
+		outwardNormal := hit.frame.Transform(Vec3{local.X(), local.Y(), k2 * (hit.height - local.Z())}).Normalize()
+		rec.SetFaceNormal(r, outwardNormal)
+		rec.objectP, rec.objectNormal = rec.p, outwardNormal
+		rec.u = phi / (2 * math.Pi)
+		rec.v = local.Z() / hit.height
+		rec.dpdu = hit.frame.Transform(Vec3{-local.Y(), local.X(), 0}.Muln(2 * math.Pi))
+		rec.dpdv = hit.frame.Transform(Vec3{-hit.radius * math.Cos(phi), -hit.radius * math.Sin(phi), hit.height})
+		rec.mat = hit.mat
+		return true, rec
+	}
+
+	return false, HitRecord{}
+}
+
+func (hit Cone) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Cone) PDFValue(origin Point3, direction Vec3) float64 {
+	return AreaPDFValue(hit, hit.area, origin, direction)
+}
+
+func (hit Cone) Random(origin Point3, s Sampler) Vec3 {
+	// The circumference grows linearly away from the apex, so the slant distance from the apex
+	// is sampled proportionally to itself.
+	r1, r2 := s.Get2D()
+	slant := math.Sqrt(r1)
+	phi := 2 * math.Pi * r2
+	local := Vec3{slant * hit.radius * math.Cos(phi), slant * hit.radius * math.Sin(phi), hit.height * (1 - slant)}
+	return hit.base.Add(hit.frame.Transform(local)).Sub(origin)
+}
+
+type Torus struct {
+	center      Point3
+	frame       ONB // Local frame with the axis as W
+	majorRadius float64
+	minorRadius float64
+	mat         Material
+	bbox        AABB
+	area        float64
+}
+
+func NewTorus(center Point3, axis Vec3, majorRadius, minorRadius float64, mat Material) Torus {
+	// A ring of tube radius minorRadius swept around the axis at distance majorRadius.
+	frame := NewONB(axis)
+	extent := DiskExtent(frame.W(), majorRadius).Add(Vec3{minorRadius, minorRadius, minorRadius})
+	bbox := NewAABBPoint(center.Sub(extent), center.Add(extent))
+	area := 4 * math.Pi * math.Pi * majorRadius * minorRadius
+	return Torus{center, frame, majorRadius, minorRadius, mat, bbox, area}
+}
+
+func (hit Torus) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	// Intersect in the local frame, where the torus is
+	// (x^2 + y^2 + z^2 + R^2 - r^2)^2 = 4 R^2 (x^2 + y^2), a quartic along the ray.
+	rayLength := r.dir.Length()
+	o := hit.frame.ToLocal(r.orig.Sub(hit.center))
+	d := hit.frame.ToLocal(r.dir).Divn(rayLength)
+
+	// The quartic is badly conditioned far from the torus, so solve it from the point where
+	// the ray enters the bounding sphere.
+	start := math.Max(0, -o.Dot(d)-(hit.majorRadius+hit.minorRadius))
+	o = o.Add(d.Muln(start))
+
+	R2 := hit.majorRadius * hit.majorRadius
+	r2 := hit.minorRadius * hit.minorRadius
+	e := o.Dot(o) - R2 - r2
+	f := o.Dot(d)
+	coeffs := [5]float64{
+		e*e - 4*R2*(r2-o.Z()*o.Z()),
+		4*f*e + 8*R2*o.Z()*d.Z(),
+		2*e + 4*f*f + 4*R2*d.Z()*d.Z(),
+		4 * f,
+		1,
+	}
+
+	for _, root := range SolveQuartic(coeffs) {
+		t := (start + root) / rayLength
+		if !intvl.Surrounds(t) {
+			continue
+		}
+		local := o.Add(d.Muln(root))
+
+		param := local.Dot(local) - R2 - r2
+		outwardNormal := hit.frame.Transform(Vec3{local.X() * param, local.Y() * param, local.Z() * (param + 2*R2)}).Normalize()
+
+		theta := math.Atan2(local.Y(), local.X())
+		if theta < 0 {
+			theta += 2 * math.Pi
+		}
+		phi := math.Atan2(local.Z(), math.Hypot(local.X(), local.Y())-hit.majorRadius)
+		if phi < 0 {
+			phi += 2 * math.Pi
+		}
+
+		rec := HitRecord{}
+		rec.t = t
+		rec.p = r.At(t)
+		rec.SetFaceNormal(r, outwardNormal)
+		rec.objectP, rec.objectNormal = rec.p, outwardNormal
+		rec.u = theta / (2 * math.Pi)
+		rec.v = phi / (2 * math.Pi)
+		rec.dpdu = hit.frame.Transform(Vec3{-local.Y(), local.X(), 0}.Muln(2 * math.Pi))
+		tube := Vec3{-math.Sin(phi) * math.Cos(theta), -math.Sin(phi) * math.Sin(theta), math.Cos(phi)}
+		rec.dpdv = hit.frame.Transform(tube.Muln(2 * math.Pi * hit.minorRadius))
+		rec.mat = hit.mat
+		return true, rec
+	}
+
+	return false, HitRecord{}
+}
+
+func (hit Torus) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit Torus) PDFValue(origin Point3, direction Vec3) float64 {
+	return AreaPDFValue(hit, hit.area, origin, direction)
+}
+
+func (hit Torus) Random(origin Point3, s Sampler) Vec3 {
+	// The outer side of the tube has more area than the inner side, so angles around the tube
+	// are sampled in proportion to the distance from the axis, R + r cos(phi), by inverting
+	// its integral with Newton's method.
+	r1, r2 := s.Get2D()
+	theta := 2 * math.Pi * r1
+	target := 2 * math.Pi * hit.majorRadius * r2
+	phi := 2 * math.Pi * r2
+	for range 8 {
+		f := hit.majorRadius*phi + hit.minorRadius*math.Sin(phi) - target
+		phi = Clamp(phi-f/(hit.majorRadius+hit.minorRadius*math.Cos(phi)), 0, 2*math.Pi)
+	}
+	ring := hit.majorRadius + hit.minorRadius*math.Cos(phi)
+	local := Vec3{ring * math.Cos(theta), ring * math.Sin(theta), hit.minorRadius * math.Sin(phi)}
+	return hit.center.Add(hit.frame.Transform(local)).Sub(origin)
+}
+
+type InfinitePlane struct {
+	point  Point3
+	frame  ONB // Local frame with the normal as W, U and V give the texture coordinates
+	mat    Material
+	bbox   AABB
+	normal Vec3
+}
+
+func NewInfinitePlane(point Point3, normal Vec3, mat Material) InfinitePlane {
+	// An unbounded plane through the point. The texture coordinates are the distances along
+	// two axes in the plane, so tiling textures should use UV transforms or repeat wrapping.
+	frame := NewONB(normal)
+	bbox := UniverseAABB
+	for axis := range 3 {
+		// Only a plane facing a world axis has a finite extent, along that axis.
+		if math.Abs(frame.W()[axis]) > 1-1e-12 {
+			bbox[axis] = Interval{point[axis], point[axis]}.Expand(0.0001)
+		}
+	}
+	return InfinitePlane{point, frame, mat, bbox, frame.W()}
+}
+
+func (hit InfinitePlane) Hit(r Ray, intvl Interval) (bool, HitRecord) {
+	denom := hit.normal.Dot(r.dir)
+
+	// No hit if the ray is parallel to the plane.
+	if math.Abs(denom) < 1e-8 {
+		return false, HitRecord{}
+	}
+
+	t := hit.normal.Dot(hit.point.Sub(r.orig)) / denom
+	if !intvl.Contains(t) {
+		return false, HitRecord{}
+	}
+
+	rec := HitRecord{}
+	rec.t = t
+	rec.p = r.At(t)
+	rec.SetFaceNormal(r, hit.normal)
+	rec.objectP, rec.objectNormal = rec.p, hit.normal
+	planar := hit.frame.ToLocal(rec.p.Sub(hit.point))
+	rec.u, rec.v = planar.X(), planar.Y()
+	rec.dpdu, rec.dpdv = hit.frame.U(), hit.frame.V()
+	rec.mat = hit.mat
+
+	return true, rec
+}
+
+func (hit InfinitePlane) BoundingBox() AABB {
+	return hit.bbox
+}
+
+func (hit InfinitePlane) PDFValue(origin Point3, direction Vec3) float64 {
+	// The plane covers the whole hemisphere facing it, which is sampled by cosine.
+	toward := hit.Toward(origin)
+	cosine := direction.Normalize().Dot(toward)
+	if toward.NearZero() || cosine <= 0 {
+		return 0
+	}
+	return cosine / math.Pi
+}
+
+func (hit InfinitePlane) Random(origin Point3, s Sampler) Vec3 {
+	toward := hit.Toward(origin)
+	if toward.NearZero() {
+		return hit.normal
+	}
+	return NewONB(toward).Transform(SampleCosineDirection(s.Get2D()))
+}
+
+func (hit InfinitePlane) Toward(origin Point3) Vec3 {
+	// Returns the normal pointing from the origin's side of the plane to the plane.
+	side := hit.normal.Dot(origin.Sub(hit.point))
+	if side > 0 {
+		return hit.normal.Muln(-1)
+	} else if side < 0 {
+		return hit.normal
+	}
+	return Vec3{}
+}
+
+func SolveQuadratic(a, h, c float64) []float64 {
+	// Returns the real roots of a t^2 - 2 h t + c = 0 in increasing order, the same form as
+	// the sphere intersection. Falls back to the linear equation when a vanishes.
+	if math.Abs(a) < 1e-12 {
+		if math.Abs(h) < 1e-12 {
+			return nil
+		}
+		return []float64{c / (2 * h)}
+	}
+
+	discriminant := h*h - a*c
+	if discriminant < 0 {
+		return nil
+	}
+
+	sqrtd := math.Sqrt(discriminant)
+	roots := []float64{(h - sqrtd) / a, (h + sqrtd) / a}
+	if roots[0] > roots[1] {
+		roots[0], roots[1] = roots[1], roots[0]
+	}
+	return roots
+}
+
+func SolveCubic(c [4]float64) []float64 {
+	// Returns the real roots of c[0] + c[1] x + c[2] x^2 + c[3] x^3, using Cardano's formula on
+	// the depressed cubic.
+	const eps = 1e-9
+	a := c[2] / c[3]
+	b := c[1] / c[3]
+	d := c[0] / c[3]
+
+	sqA := a * a
+	p := (-sqA/3 + b) / 3
+	q := (2*a*sqA/27 - a*b/3 + d) / 2
+	cbP := p * p * p
+	discriminant := q*q + cbP
+
+	var roots []float64
+	if math.Abs(discriminant) < eps {
+		if math.Abs(q) < eps {
+			roots = []float64{0}
+		} else {
+			u := math.Cbrt(-q)
+			roots = []float64{2 * u, -u}
+		}
+	} else if discriminant < 0 {
+		phi := math.Acos(-q/math.Sqrt(-cbP)) / 3
+		t := 2 * math.Sqrt(-p)
+		roots = []float64{t * math.Cos(phi), -t * math.Cos(phi+math.Pi/3), -t * math.Cos(phi-math.Pi/3)}
+	} else {
+		sqrtd := math.Sqrt(discriminant)
+		roots = []float64{math.Cbrt(sqrtd-q) - math.Cbrt(sqrtd+q)}
+	}
+
+	for i := range roots {
+		roots[i] -= a / 3
+	}
+	return roots
+}
+
+func SolveQuartic(c [5]float64) []float64 {
+	// Returns the real roots of c[0] + c[1] x + ... + c[4] x^4 in increasing order, using
+	// Ferrari's method followed by a few Newton steps to recover precision.
+	const eps = 1e-9
+	a := c[3] / c[4]
+	b := c[2] / c[4]
+	d := c[1] / c[4]
+	e := c[0] / c[4]
+
+	// Substitute x = y - a/4 to eliminate the cubic term: y^4 + p y^2 + q y + r = 0.
+	sqA := a * a
+	p := -3*sqA/8 + b
+	q := sqA*a/8 - a*b/2 + d
+	r := -3*sqA*sqA/256 + sqA*b/16 - a*d/4 + e
+
+	var roots []float64
+	if math.Abs(r) < eps {
+		// No absolute term: y (y^3 + p y + q) = 0.
+		roots = append(SolveCubic([4]float64{q, p, 0, 1}), 0)
+	} else {
+		// Solve the resolvent cubic, and split the quartic into two quadratics with one root.
+		z := SolveCubic([4]float64{r*p/2 - q*q/8, -r, -p / 2, 1})[0]
+
+		u := z*z - r
+		v := 2*z - p
+		if math.Abs(u) < eps {
+			u = 0
+		} else if u > 0 {
+			u = math.Sqrt(u)
+		} else {
+			return nil
+		}
+		if math.Abs(v) < eps {
+			v = 0
+		} else if v > 0 {
+			v = math.Sqrt(v)
+		} else {
+			return nil
+		}
+		if q < 0 {
+			v = -v
+		}
+
+		roots = append(roots, SolveMonicQuadratic(v, z-u)...)
+		roots = append(roots, SolveMonicQuadratic(-v, z+u)...)
+	}
+
+	for i := range roots {
+		x := roots[i] - a/4
+		for range 2 {
+			f := (((c[4]*x+c[3])*x+c[2])*x+c[1])*x + c[0]
+			df := ((4*c[4]*x+3*c[3])*x+2*c[2])*x + c[1]
+			if df == 0 {
+				break
+			}
+			x -= f / df
+		}
+		roots[i] = x
+	}
+
+	sort.Float64s(roots)
+	return roots
+}
+
+func SolveMonicQuadratic(b, c float64) []float64 {
+	// Returns the real roots of x^2 + b x + c.
+	p := b / 2
+	discriminant := p*p - c
+	if discriminant < 0 {
+		return nil
+	}
+	sqrtd := math.Sqrt(discriminant)
+	return []float64{-p - sqrtd, -p + sqrtd}
+}
@@ -0,0 +1,193 @@
+package main
+
+import "math"
+
+func TextureRecord(u, v float64, p Point3) HitRecord {
+	// Builds the hit record seen by a texture node evaluated through Value, where only the
+	// texture coordinates and the point are known.
+	return HitRecord{p: p, u: u, v: v, objectP: p}
+}
+
+type UVTransform struct {
+	tex              Texture
+	scaleU, scaleV   float64
+	offsetU, offsetV float64
+	sinTheta         float64
+	cosTheta         float64
+}
+
+func NewUVTransform(tex Texture, scaleU, scaleV, offsetU, offsetV, angle float64) UVTransform {
+	// Scales the texture coordinates, rotates them by angle degrees and then offsets them
+	// before looking up the input texture.
+	radians := Radians(angle)
+	return UVTransform{tex, scaleU, scaleV, offsetU, offsetV, math.Sin(radians), math.Cos(radians)}
+}
+
+func (t UVTransform) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t UVTransform) HitValue(rec HitRecord) RGB {
+	su := rec.u * t.scaleU
+	sv := rec.v * t.scaleV
+	rec.u = t.cosTheta*su - t.sinTheta*sv + t.offsetU
+	rec.v = t.sinTheta*su + t.cosTheta*sv + t.offsetV
+	return TextureValue(t.tex, rec)
+}
+
+type UVCheckerTexture struct {
+	scaleU, scaleV float64
+	even           Texture
+	odd            Texture
+}
+
+func NewUVCheckerTexture(scaleU, scaleV float64, even, odd Texture) UVCheckerTexture {
+	// A checker with scaleU by scaleV squares over the [0,1] texture coordinate range, so it
+	// follows the surface parameterization instead of world space.
+	return UVCheckerTexture{scaleU, scaleV, even, odd}
+}
+
+func (t UVCheckerTexture) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t UVCheckerTexture) HitValue(rec HitRecord) RGB {
+	x := int(math.Floor(t.scaleU * rec.u))
+	y := int(math.Floor(t.scaleV * rec.v))
+
+	if (x+y)%2 == 0 {
+		return TextureValue(t.even, rec)
+	} else {
+		return TextureValue(t.odd, rec)
+	}
+}
+
+type BlendMode int
+
+const (
+	BlendMix      BlendMode = iota // Replace the base by the layer
+	BlendMultiply                  // Multiply the base by the layer
+	BlendAdd                       // Add the layer to the base
+)
+
+type BlendTexture struct {
+	mode  BlendMode
+	base  Texture
+	layer Texture
+	mask  Texture
+}
+
+func NewBlendTexture(mode BlendMode, base, layer, mask Texture) BlendTexture {
+	// Combines the layer with the base, applied as much as the mask says: not at all where the
+	// mask is black and fully where it is white.
+	return BlendTexture{mode, base, layer, mask}
+}
+
+func (t BlendTexture) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t BlendTexture) HitValue(rec HitRecord) RGB {
+	base := TextureValue(t.base, rec)
+	layer := TextureValue(t.layer, rec)
+	mask := Clamp(TextureValue(t.mask, rec).Average(), 0, 1)
+
+	blended := layer
+	switch t.mode {
+	case BlendMultiply:
+		blended = base.Mul(layer)
+	case BlendAdd:
+		blended = base.Add(layer)
+	}
+
+	return Lerp(base, blended, mask)
+}
+
+type RampTexture struct {
+	input Texture
+	ramp  ColorRamp
+}
+
+func NewRampTexture(input Texture, ramp ColorRamp) RampTexture {
+	// Maps the gray level of the input texture to a color.
+	return RampTexture{input, ramp}
+}
+
+func (t RampTexture) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t RampTexture) HitValue(rec HitRecord) RGB {
+	return t.ramp.Value(TextureValue(t.input, rec).Average())
+}
+
+type CoordSpace int
+
+const (
+	SpaceWorld  CoordSpace = iota // Positions and normals after all transforms
+	SpaceObject                   // Positions and normals of the untransformed primitive
+)
+
+type ObjectSpaceTexture struct {
+	tex Texture
+}
+
+func (t ObjectSpaceTexture) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t ObjectSpaceTexture) HitValue(rec HitRecord) RGB {
+	// Evaluates a position based texture like CheckerTexture in object space, so the pattern
+	// sticks to the object when it is moved or rotated.
+	rec.p = rec.objectP
+	return TextureValue(t.tex, rec)
+}
+
+type TriplanarTexture struct {
+	tex       Texture
+	scale     float64
+	sharpness float64
+	space     CoordSpace
+}
+
+func NewTriplanarTexture(tex Texture, scale, sharpness float64, space CoordSpace) TriplanarTexture {
+	// Projects a texture along the three axes and blends the projections by how much the
+	// normal faces each axis, for surfaces without usable texture coordinates. Higher
+	// sharpness narrows the blend between projections.
+	return TriplanarTexture{tex, scale, sharpness, space}
+}
+
+func (t TriplanarTexture) Value(u, v float64, p Point3) RGB {
+	return t.HitValue(TextureRecord(u, v, p))
+}
+
+func (t TriplanarTexture) HitValue(rec HitRecord) RGB {
+	p, n := rec.p, rec.geomNormal
+	if t.space == SpaceObject {
+		p, n = rec.objectP, rec.objectNormal
+	}
+
+	weights := Vec3{}
+	sum := 0.0
+	for axis := range 3 {
+		weights[axis] = math.Pow(math.Abs(n[axis]), t.sharpness)
+		sum += weights[axis]
+	}
+	if sum == 0 {
+		weights, sum = Vec3{1, 1, 1}, 3
+	}
+
+	// Each projection drops the axis it looks along, keeping the other two as u and v.
+	q := p.Muln(t.scale)
+	planes := [3][2]float64{{q.Z(), q.Y()}, {q.X(), q.Z()}, {q.X(), q.Y()}}
+	result := RGB{}
+	for axis := range 3 {
+		if weights[axis] == 0 {
+			continue
+		}
+		rec.u, rec.v = planes[axis][0], planes[axis][1]
+		result = result.Add(TextureValue(t.tex, rec).Muln(weights[axis] / sum))
+	}
+
+	return result
+}
@@ -44,12 +44,64 @@ func (t CheckerTexture) Value(u, v float64, p Point3) RGB {
 	}
 }
 
+type FilteredTexture interface {
+	// Textures that can average their value over the footprint of the ray cone at the hit.
+	Texture
+	FilteredValue(rec HitRecord) RGB
+}
+
+type AnimatedTexture interface {
+	// Textures that change over the shutter interval.
+	Texture
+	ValueAt(u, v float64, p Point3, tm float64) RGB
+}
+
+type HitTexture interface {
+	// Textures that need more of the hit than the texture coordinates and the point, such as
+	// the normal or the object space position, and pass it on to their input textures.
+	Texture
+	HitValue(rec HitRecord) RGB
+}
+
+func TextureValue(tex Texture, rec HitRecord) RGB {
+	// Returns the texture value at the hit, filtered over its footprint or evaluated at the time
+	// of the ray when supported.
+	if node, ok := tex.(HitTexture); ok {
+		return node.HitValue(rec)
+	}
+	if filtered, ok := tex.(FilteredTexture); ok && rec.footprint > 0 {
+		return filtered.FilteredValue(rec)
+	}
+	if animated, ok := tex.(AnimatedTexture); ok {
+		return animated.ValueAt(rec.u, rec.v, rec.p, rec.tm)
+	}
+	return tex.Value(rec.u, rec.v, rec.p)
+}
+
+type TextureFilter int
+
+const (
+	FilterNearest   TextureFilter = iota // Closest texel
+	FilterBilinear                       // Blend of the four closest texels
+	FilterTrilinear                      // Blend of bilinear lookups in the two closest mip levels
+)
+
 type ImageTexture struct {
 	rtwImage RTWImage
+	filter   TextureFilter
+	wrap     WrapMode
 }
 
 func NewImageTexture(filename string) ImageTexture {
-	return ImageTexture{NewRTWImage(filename)}
+	return ImageTexture{rtwImage: NewRTWImage(filename)}
+}
+
+func NewImageTextureFiltered(filename string, colorSpace ColorSpace, filter TextureFilter, wrap WrapMode) ImageTexture {
+	img := NewRTWImageColorSpace(filename, colorSpace)
+	if filter == FilterTrilinear {
+		img.GenerateMipmaps()
+	}
+	return ImageTexture{img, filter, wrap}
 }
 
 func (t ImageTexture) Value(u, v float64, p Point3) RGB {
@@ -58,14 +110,71 @@ func (t ImageTexture) Value(u, v float64, p Point3) RGB {
 		return RGB{0, 1, 1}
 	}
 
-	// Clamp input texture coordinates to [0,1] x [1,0]
-	u = Interval{0, 1}.Clamp(u)
-	v = 1 - Interval{0, 1}.Clamp(v) // Flip V to image coordinates
+	if t.filter != FilterNearest {
+		return t.rtwImage.Bilerp(u, 1-v, t.wrap)
+	}
+
+	if t.wrap == WrapClamp {
+		// Clamp input texture coordinates to [0,1] x [1,0]
+		u = Interval{0, 1}.Clamp(u)
+		v = Interval{0, 1}.Clamp(v)
+	}
+	v = 1 - v // Flip V to image coordinates
+
+	i := int(math.Floor(u * float64(t.rtwImage.width)))
+	j := int(math.Floor(v * float64(t.rtwImage.height)))
+
+	return t.rtwImage.GetWrapped(i, j, t.wrap)
+}
+
+func (t ImageTexture) FilteredValue(rec HitRecord) RGB {
+	if t.filter != FilterTrilinear || t.rtwImage.height <= 0 {
+		return t.Value(rec.u, rec.v, rec.p)
+	}
+
+	// Estimate how many texels the ray cone covers from the world space size of one texel,
+	// and pick the mip level where that footprint shrinks to a single texel.
+	texelU := rec.dpdu.Length() / float64(t.rtwImage.width)
+	texelV := rec.dpdv.Length() / float64(t.rtwImage.height)
+	texelSize := math.Min(texelU, texelV)
+	if texelSize <= 0 {
+		return t.Value(rec.u, rec.v, rec.p)
+	}
+
+	lod := math.Log2(math.Max(rec.footprint/texelSize, 1))
+	return t.rtwImage.Trilerp(rec.u, 1-rec.v, lod, t.wrap)
+}
+
+func (t ImageTexture) Alpha(u, v float64) float64 {
+	// Returns the image opacity at the texture coordinates, fully opaque if there is no image.
+	if t.rtwImage.height <= 0 {
+		return 1
+	}
+
+	if t.filter != FilterNearest {
+		return t.rtwImage.BilerpAlpha(u, 1-v, t.wrap)
+	}
+
+	if t.wrap == WrapClamp {
+		u = Interval{0, 1}.Clamp(u)
+		v = Interval{0, 1}.Clamp(v)
+	}
+	v = 1 - v
+
+	i := int(math.Floor(u * float64(t.rtwImage.width)))
+	j := int(math.Floor(v * float64(t.rtwImage.height)))
 
-	i := int(u * float64(t.rtwImage.width))
-	j := int(v * float64(t.rtwImage.height))
+	return t.rtwImage.GetAlpha(i, j, t.wrap)
+}
 
-	return t.rtwImage.Get(i, j)
+type ImageAlphaTexture struct {
+	// Exposes the alpha channel of an image texture as a grayscale texture.
+	image ImageTexture
+}
+
+func (t ImageAlphaTexture) Value(u, v float64, p Point3) RGB {
+	alpha := t.image.Alpha(u, v)
+	return RGB{alpha, alpha, alpha}
 }
 
 type NoiseTexture struct {
@@ -77,6 +186,51 @@ func NewNoiseTexture(scale float64) NoiseTexture {
 	return NoiseTexture{NewPerlin(), scale}
 }
 
+func NewNoiseTextureSeeded(scale float64, seed uint64, period int) NoiseTexture {
+	// The turbulence repeats every period units, or never when the period is 0. The stripes
+	// along z repeat every 2π/scale units, so the marble tiles when that divides the period.
+	return NoiseTexture{NewPerlinPeriodic(seed, period), scale}
+}
+
 func (t NoiseTexture) Value(u, v float64, p Point3) RGB {
 	return RGB{0.5, 0.5, 0.5}.Muln(1 + math.Sin(t.scale*p.Z()+10*t.noise.Turb(p, 7)))
 }
+
+type AnimatedNoiseTexture struct {
+	noise Perlin
+	scale float64
+	speed float64
+}
+
+func NewAnimatedNoiseTexture(scale, speed float64, seed uint64, period int) AnimatedNoiseTexture {
+	// The turbulence repeats every period units in space and time, or never when the period
+	// is 0.
+	return AnimatedNoiseTexture{NewPerlinPeriodic(seed, period), scale, speed}
+}
+
+func (t AnimatedNoiseTexture) Value(u, v float64, p Point3) RGB {
+	return t.ValueAt(u, v, p, 0)
+}
+
+func (t AnimatedNoiseTexture) ValueAt(u, v float64, p Point3, tm float64) RGB {
+	// The marble of NoiseTexture, with the turbulence evolving over time at the given speed.
+	return RGB{0.5, 0.5, 0.5}.Muln(1 + math.Sin(t.scale*p.Z()+10*t.noise.Turb4(p, t.speed*tm, 7)))
+}
+
+type SimplexTexture struct {
+	noise Perlin
+	scale float64
+	low   Texture
+	high  Texture
+}
+
+func NewSimplexTexture(scale float64, seed uint64, low, high Texture) SimplexTexture {
+	// Simplex noise doesn't tile, so unlike the other seeded noise textures this one has no
+	// period.
+	return SimplexTexture{NewPerlinSeeded(seed), scale, low, high}
+}
+
+func (t SimplexTexture) Value(u, v float64, p Point3) RGB {
+	f := 0.5 + 0.5*t.noise.Simplex(p.Muln(t.scale))
+	return Lerp(t.low.Value(u, v, p), t.high.Value(u, v, p), Clamp(f, 0, 1))
+}
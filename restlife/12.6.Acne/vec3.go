@@ -66,6 +66,10 @@ func (v Vec3) Cross(o Vec3) Vec3 {
 	return Vec3{x, y, z}
 }
 
+func (v Vec3) Average() float64 {
+	return (v[0] + v[1] + v[2]) / 3
+}
+
 func (v Vec3) Length() float64 {
 	return math.Sqrt(float64(v.Dot(v)))
 }
@@ -135,10 +139,32 @@ func RandomInUnitDisk() Vec3 {
 	}
 }
 
-func RandomCosineDirection() Vec3 {
-	r1 := rand.Float64()
-	r2 := rand.Float64()
+func SampleUnitVector(r1, r2 float64) Vec3 {
+	// Maps a 2D sample to a uniformly distributed direction.
+	z := 1 - 2*r2
+	phi := 2 * math.Pi * r1
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	return Vec3{r * math.Cos(phi), r * math.Sin(phi), z}
+}
 
+func SampleUnitDisk(r1, r2 float64) Vec3 {
+	// Maps a 2D sample to a uniformly distributed point in the unit disk with Shirley's
+	// concentric mapping, which keeps samples that are spread evenly in the square spread
+	// evenly in the disk.
+	a, b := 2*r1-1, 2*r2-1
+	if a == 0 && b == 0 {
+		return Vec3{}
+	}
+	var r, phi float64
+	if math.Abs(a) > math.Abs(b) {
+		r, phi = a, math.Pi/4*(b/a)
+	} else {
+		r, phi = b, math.Pi/2-math.Pi/4*(a/b)
+	}
+	return Vec3{r * math.Cos(phi), r * math.Sin(phi), 0}
+}
+
+func SampleCosineDirection(r1, r2 float64) Vec3 {
 	phi := 2 * math.Pi * r1
 	x := math.Cos(phi) * math.Sqrt(r2)
 	y := math.Sin(phi) * math.Sqrt(r2)
@@ -147,9 +173,7 @@ func RandomCosineDirection() Vec3 {
 	return Vec3{x, y, z}
 }
 
-func RandomToSphere(radius, distanceSquared float64) Vec3 {
-	r1 := rand.Float64()
-	r2 := rand.Float64()
+func SampleToSphere(radius, distanceSquared, r1, r2 float64) Vec3 {
 	z := 1 + r2*(math.Sqrt(1-radius*radius/distanceSquared)-1)
 
 	phi := 2 * math.Pi * r1
@@ -159,6 +183,11 @@ func RandomToSphere(radius, distanceSquared float64) Vec3 {
 	return Vec3{x, y, z}
 }
 
+func Lerp(a, b Vec3, t float64) Vec3 {
+	// Linearly interpolates from a at t = 0 to b at t = 1.
+	return a.Muln(1 - t).Add(b.Muln(t))
+}
+
 func Radians(degrees float64) float64 {
 	return degrees * math.Pi / 180
 }